@@ -30,11 +30,16 @@ package main
  */
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -44,6 +49,8 @@ type SmartContract struct {
 
 type Company struct {
 	Name string `json:"name"`
+	// MSPID is the organization whose peers must endorse changes to the clinic's cards
+	MSPID string `json:"mspID"`
 }
 
 type Type struct {
@@ -61,14 +68,25 @@ type Card struct {
 	UserID    string `json:"userID"`
 	CompanyID string `json:"companyID"`
 	Name      string `json:"name"`
+	// OrgMSPID is the owning clinic's organization, see setCardEndorsementPolicy
+	OrgMSPID string `json:"orgMSPID"`
+	// Head, HeadHash and Length point at the last item of the card's hash chain,
+	// so appending an item never has to walk the chain
+	Head     string `json:"head"`
+	HeadHash string `json:"headHash"`
+	Length   int    `json:"length"`
 }
 
 type CardItem struct {
-	card          string `json:"card"`
+	Card          string `json:"card"`
 	Key           string `json:"key"`
 	Value         string `json:"value"`
 	AditionalData string `json:"aditionalData"`
 	Date          string `json:"date"`
+	// Seq is the position of the item in its card's chain and PrevHash is the
+	// sha256 of the previous item as stored on the ledger ("" for the first item)
+	Seq      int    `json:"seq"`
+	PrevHash string `json:"prevHash"`
 }
 
 /*
@@ -94,23 +112,47 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	if function == "queryPerson" {
 		return s.queryCar(APIstub, args)
 	} else if function == "initLedger" {
-		return s.initLedger(APIstub)
+		return s.initLedger(APIstub, args)
 	} else if function == "createCar" {
 		return s.createCar(APIstub, args)
 	} else if function == "queryPersons" {
-		return s.queryAllUsers(APIstub)
+		return s.queryAllUsers(APIstub, args)
 	} else if function == "changeCarOwner" {
 		return s.changeCarOwner(APIstub, args)
 	} else if function == "queryAllClinics" {
-		return s.queryAllClinics(APIstub)
+		return s.queryAllClinics(APIstub, args)
 	} else if function == "queryAllResearches" {
-		return s.queryAllResearches(APIstub)
+		return s.queryAllResearches(APIstub, args)
 	} else if function == "queryResearche" {
 		return s.subscribe(APIstub, args)
 	} else if function == "getAllSubscribers" {
 		return s.getAllSubscribers(APIstub, args)
 	} else if function == "queryCardItemByCARDID" {
 		return s.queryCardItemByCardID(APIstub, args)
+	} else if function == "addCardItem" {
+		return s.addCardItem(APIstub, args)
+	} else if function == "verifyCardChain" {
+		return s.verifyCardChain(APIstub, args)
+	} else if function == "grantBreakGlassAccess" {
+		return s.grantBreakGlassAccess(APIstub, args)
+	} else if function == "breakGlassRead" {
+		return s.breakGlassRead(APIstub, args)
+	} else if function == "queryBreakGlassAccesses" {
+		return s.queryBreakGlassAccesses(APIstub, args)
+	} else if function == "registerResearch" {
+		return s.registerResearch(APIstub, args)
+	} else if function == "enrollInResearch" {
+		return s.enrollInResearch(APIstub, args)
+	} else if function == "withdrawFromResearch" {
+		return s.withdrawFromResearch(APIstub, args)
+	} else if function == "publishToResearch" {
+		return s.publishToResearch(APIstub, args)
+	} else if function == "queryResearchEnrollment" {
+		return s.queryResearchEnrollment(APIstub, args)
+	} else if function == "registerClinic" {
+		return s.registerClinic(APIstub, args)
+	} else if function == "transferCard" {
+		return s.transferCard(APIstub, args)
 	}
 
 	return shim.Error("Invalid Smart Contract function name. 1")
@@ -135,19 +177,111 @@ func (t *SmartContract) queryCardItemByCardID(APIstub shim.ChaincodeStubInterfac
 
 	cardID := args[0] //strings.ToUpper(args[0])
 
+	opts, err := parseResultSetOptions(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	//	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"carditem\",\"card\":\"%s\"}}", cardID)
 	//queryString := fmt.Sprintf("{\"selector\":%s}", cardID)
 
-	queryResults, err := getStateByPartialCompositeKey(APIstub, "carditem~card", []string{cardID})
+	queryResults, err := getStateByPartialCompositeKey(APIstub, "carditem~card", []string{cardID}, opts)
 
-	//	queryResults, err := getQueryResultForQueryString(APIstub, queryString)
+	//	queryResults, err := getQueryResultForQueryString(APIstub, queryString, opts)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(queryResults)
 }
 
-func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
+func (s *SmartContract) addCardItem(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//     0        1       2           3             4
+	// "CARD0", "key", "value", "aditionalData", "date"
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	cardID := args[0]
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// ==== Only staff of the clinic that owns the card may write to it ====
+	if err := assertRole(APIstub, "staff"); err != nil {
+		return shim.Error(err.Error())
+	}
+	author, err := getSubmitter(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if author.MSPID != card.OrgMSPID {
+		return shim.Error("Only staff of the clinic that owns card " + cardID + " can add items to it")
+	}
+
+	cardItem := CardItem{Key: args[1], Value: args[2], AditionalData: args[3], Date: args[4]}
+	cardItemKey, err := appendCardItem(APIstub, cardID, card, &cardItem)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(cardItemKey))
+}
+
+// cardChainBreak describes the first link of a card's chain that does not verify.
+type cardChainBreak struct {
+	Seq    int    `json:"seq"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+type cardChainReport struct {
+	Card     string          `json:"card"`
+	Length   int             `json:"length"`
+	Valid    bool            `json:"valid"`
+	BrokenAt *cardChainBreak `json:"brokenAt,omitempty"`
+}
+
+func (s *SmartContract) verifyCardChain(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//    0
+	// "CARD0"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	cardID := args[0]
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report := cardChainReport{Card: cardID, Length: card.Length, Valid: true}
+	brokenAt, err := checkCardChain(APIstub, cardID, card)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if brokenAt != nil {
+		report.Valid = false
+		report.BrokenAt = brokenAt
+	}
+
+	reportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(reportAsBytes)
+}
+
+func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//     0
+	// "Org1MSP"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting the MSP ID of the clinics' organization")
+	}
+	clinicMSPID := args[0]
+
 	users := []User{
 		User{FirstName: "Pavel", LastName: "Pantyukhov", ImageUrl: "https://pp.userapi.com/c638918/v638918847/3d1d9/s_auB5cvB6M.jpg", Hash: "3u891738291hdiawhduiawdhiuawd"},
 		User{FirstName: "Pavel", LastName: "Pantyukhov", ImageUrl: "https://pp.userapi.com/c638918/v638918847/3d1d9/s_auB5cvB6M.jpg", Hash: "3u891738291hdiawhduiawdhiuawd"},
@@ -192,38 +326,34 @@ func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Respo
 	j := 0
 	for j < len(companies) {
 		fmt.Println("j is ", j)
-		asBytes, _ := json.Marshal(companies[j])
-		APIstub.PutState("COMPANY"+strconv.Itoa(j), asBytes)
+		companies[j].MSPID = clinicMSPID
+		if _, err := putClinic(APIstub, "COMPANY"+strconv.Itoa(j), companies[j]); err != nil {
+			return shim.Error(err.Error())
+		}
 		fmt.Println("Added", companies[j])
 		j = j + 1
 	}
 
 	for j := 0; j < 20; j++ {
-		card := Card{UserID: "USER0", CompanyID: "COMPANY0", Name: "Карточка"}
+		card := Card{UserID: "USER0", CompanyID: "COMPANY0", Name: "Карточка", OrgMSPID: companies[0].MSPID}
 		asBytes, _ := json.Marshal(card)
 
 		fmt.Println("CARD", card)
 		key := "CARD" + strconv.Itoa(j)
 		APIstub.PutState(key, asBytes)
 
-		for k := 0; k < 20; k++ {
-			cardItem := CardItem{card: key, Key: "Принятие таблетки 1", Value: "1", AditionalData: "Заметка врача", Date: "2017.06.18"}
+		// appendCardItem keeps the card's head pointer up to date, rewriting the card as it goes
 
-			asBytes, _ := json.Marshal(cardItem)
-			fmt.Println("CARDITEM", cardItem)
-			cardItemKey := "CARDITEM" + strconv.Itoa(j)
-			APIstub.PutState(cardItemKey, asBytes)
+		for k := 0; k < 20; k++ {
+			cardItem := CardItem{Key: "Принятие таблетки 1", Value: "1", AditionalData: "Заметка врача", Date: "2017.06.18"}
 
-			indexName := "carditem~card"
-			colorNameIndexKey, err := APIstub.CreateCompositeKey(indexName, []string{cardItem.card, cardItemKey})
-			if err != nil {
+			if _, err := appendCardItem(APIstub, key, &card, &cardItem); err != nil {
 				return shim.Error(err.Error())
 			}
-			//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-			//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-			value := []byte{0x00}
-			APIstub.PutState(colorNameIndexKey, value)
+		}
 
+		if err := setCardEndorsementPolicy(APIstub, key, &card); err != nil {
+			return shim.Error(err.Error())
 		}
 	}
 
@@ -260,7 +390,12 @@ func (s *SmartContract) createCar(APIstub shim.ChaincodeStubInterface, args []st
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryAllClinics(APIstub shim.ChaincodeStubInterface) sc.Response {
+func (s *SmartContract) queryAllClinics(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	opts, err := parseResultSetOptions(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	startKey := "CLINIC0"
 	endKey := "CLINIC20"
@@ -271,39 +406,20 @@ func (s *SmartContract) queryAllClinics(APIstub shim.ChaincodeStubInterface) sc.
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	results, err := writeStateIterator(resultsIterator, opts)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- queryAllCars:\n%s\n", buffer.String())
-
-	return shim.Success(buffer.Bytes())
+	return shim.Success(results)
 }
 
-func (s *SmartContract) queryAllResearches(APIstub shim.ChaincodeStubInterface) sc.Response {
+func (s *SmartContract) queryAllResearches(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	opts, err := parseResultSetOptions(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	startKey := "RESEARCH0"
 	endKey := "RESEARCH2000000"
@@ -314,36 +430,12 @@ func (s *SmartContract) queryAllResearches(APIstub shim.ChaincodeStubInterface)
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	results, err := writeStateIterator(resultsIterator, opts)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- queryAllCars:\n%s\n", buffer.String())
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(results)
 }
 
 func (s *SmartContract) subscribe(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
@@ -374,6 +466,11 @@ func (s *SmartContract) subscribe(APIstub shim.ChaincodeStubInterface, args []st
 
 func (s *SmartContract) getAllSubscribers(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
+	opts, err := parseResultSetOptions(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	startKey := "RESEARCHUSER0"
 	endKey := "RESEARCHUSER2000000000"
 
@@ -384,39 +481,20 @@ func (s *SmartContract) getAllSubscribers(APIstub shim.ChaincodeStubInterface, a
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	results, err := writeStateIterator(resultsIterator, opts)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- queryAllCars:\n%s\n", buffer.String())
-
-	return shim.Success(buffer.Bytes())
+	return shim.Success(results)
 }
 
-func (s *SmartContract) queryAllUsers(APIstub shim.ChaincodeStubInterface) sc.Response {
+func (s *SmartContract) queryAllUsers(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	opts, err := parseResultSetOptions(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	startKey := "USER0"
 	endKey := "USER999"
@@ -427,36 +505,12 @@ func (s *SmartContract) queryAllUsers(APIstub shim.ChaincodeStubInterface) sc.Re
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	results, err := writeStateIterator(resultsIterator, opts)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- queryAllCars:\n%s\n", buffer.String())
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(results)
 }
 
 func (s *SmartContract) changeCarOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
@@ -477,6 +531,195 @@ func (s *SmartContract) changeCarOwner(APIstub shim.ChaincodeStubInterface, args
 	return shim.Success(nil)
 }
 
+// =========================================================================================
+// Card item chain
+// Every CardItem carries the hash of the previous item of the same card, and the card
+// itself points at the current head. Items are keyed by card and sequence number so the
+// chain can be walked from the start without an index.
+// =========================================================================================
+
+func getCard(APIstub shim.ChaincodeStubInterface, cardID string) (*Card, error) {
+	cardAsBytes, err := APIstub.GetState(cardID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get card %s: %s", cardID, err.Error())
+	} else if cardAsBytes == nil {
+		return nil, fmt.Errorf("Card does not exist: %s", cardID)
+	}
+
+	card := &Card{}
+	if err := json.Unmarshal(cardAsBytes, card); err != nil {
+		return nil, fmt.Errorf("Failed to decode card %s: %s", cardID, err.Error())
+	}
+	return card, nil
+}
+
+func cardItemKey(cardID string, seq int) string {
+	return fmt.Sprintf("CARDITEM_%s_%06d", cardID, seq)
+}
+
+func hashCardItem(cardItemAsBytes []byte) string {
+	sum := sha256.Sum256(cardItemAsBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendCardItem links cardItem onto the end of the card's chain, stores it together with
+// its carditem~card index entry and moves the card's head pointer. The card is passed in
+// rather than read back, since state written earlier in the same transaction is not visible.
+func appendCardItem(APIstub shim.ChaincodeStubInterface, cardID string, card *Card, cardItem *CardItem) (string, error) {
+	if card.OrgMSPID == "" {
+		return "", fmt.Errorf("Card %s has no owning organization", cardID)
+	}
+	cardItem.Card = cardID
+	cardItem.Seq = card.Length
+	cardItem.PrevHash = card.HeadHash
+
+	cardItemAsBytes, err := json.Marshal(cardItem)
+	if err != nil {
+		return "", err
+	}
+	key := cardItemKey(cardID, cardItem.Seq)
+	if err := APIstub.PutState(key, cardItemAsBytes); err != nil {
+		return "", err
+	}
+	// new items are held to the same endorsement policy as the card itself
+	policy, err := cardEndorsementPolicy(card.OrgMSPID)
+	if err != nil {
+		return "", err
+	}
+	if err := APIstub.SetStateValidationParameter(key, policy); err != nil {
+		return "", err
+	}
+
+	indexName := "carditem~card"
+	cardItemIndexKey, err := APIstub.CreateCompositeKey(indexName, []string{cardID, key})
+	if err != nil {
+		return "", err
+	}
+	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the item.
+	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	if err := APIstub.PutState(cardItemIndexKey, []byte{0x00}); err != nil {
+		return "", err
+	}
+
+	card.Head = key
+	card.HeadHash = hashCardItem(cardItemAsBytes)
+	card.Length++
+
+	cardAsBytes, err := json.Marshal(card)
+	if err != nil {
+		return "", err
+	}
+	if err := APIstub.PutState(cardID, cardAsBytes); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// checkCardChain recomputes the card's chain from the first item and returns the first
+// link that does not verify, or nil if the whole chain including the head pointer is intact.
+func checkCardChain(APIstub shim.ChaincodeStubInterface, cardID string, card *Card) (*cardChainBreak, error) {
+	prevHash := ""
+	for seq := 0; seq < card.Length; seq++ {
+		key := cardItemKey(cardID, seq)
+		cardItemAsBytes, err := APIstub.GetState(key)
+		if err != nil {
+			return nil, err
+		} else if cardItemAsBytes == nil {
+			return &cardChainBreak{Seq: seq, Key: key, Reason: "item is missing"}, nil
+		}
+
+		cardItem := CardItem{}
+		if err := json.Unmarshal(cardItemAsBytes, &cardItem); err != nil {
+			return &cardChainBreak{Seq: seq, Key: key, Reason: "item cannot be decoded"}, nil
+		}
+		if cardItem.Card != cardID || cardItem.Seq != seq {
+			return &cardChainBreak{Seq: seq, Key: key, Reason: "item does not belong at this position"}, nil
+		}
+		if cardItem.PrevHash != prevHash {
+			return &cardChainBreak{Seq: seq, Key: key, Reason: "previous hash does not match"}, nil
+		}
+		prevHash = hashCardItem(cardItemAsBytes)
+	}
+
+	if card.Length > 0 && (card.Head != cardItemKey(cardID, card.Length-1) || card.HeadHash != prevHash) {
+		return &cardChainBreak{Seq: card.Length - 1, Key: card.Head, Reason: "card head does not match the last item"}, nil
+	}
+	return nil, nil
+}
+
+// =========================================================================================
+// Submitter identity
+// Roles are carried as Fabric CA attributes on the enrollment certificate: "role" is
+// "staff", "patient" or "admin", and patients also carry their "userID" (e.g. USER0).
+// Staff add items to the cards of their own clinic (their MSP ID matches the card's) and
+// use break-glass access for other cards. Admins register clinics and researches and move
+// cards between clinics with transferCard.
+// =========================================================================================
+
+// submitter identifies the client that signed the current proposal.
+type submitter struct {
+	MSPID string `json:"mspID"`
+	ID    string `json:"id"`
+}
+
+// newClientIdentity reads the submitter's identity from the signed proposal. Tests replace
+// it, as MockStub has no creator certificate.
+var newClientIdentity = func(APIstub shim.ChaincodeStubInterface) (cid.ClientIdentity, error) {
+	return cid.New(APIstub)
+}
+
+func getSubmitter(APIstub shim.ChaincodeStubInterface) (submitter, error) {
+	clientIdentity, err := newClientIdentity(APIstub)
+	if err != nil {
+		return submitter{}, fmt.Errorf("Failed to get submitter identity: %s", err.Error())
+	}
+	mspID, err := clientIdentity.GetMSPID()
+	if err != nil {
+		return submitter{}, fmt.Errorf("Failed to get submitter MSP ID: %s", err.Error())
+	}
+	id, err := clientIdentity.GetID()
+	if err != nil {
+		return submitter{}, fmt.Errorf("Failed to get submitter ID: %s", err.Error())
+	}
+	return submitter{MSPID: mspID, ID: id}, nil
+}
+
+func assertAttribute(APIstub shim.ChaincodeStubInterface, attrName string, attrValue string) error {
+	clientIdentity, err := newClientIdentity(APIstub)
+	if err != nil {
+		return fmt.Errorf("Failed to get submitter identity: %s", err.Error())
+	}
+	return clientIdentity.AssertAttributeValue(attrName, attrValue)
+}
+
+// assertRole fails unless the submitter carries the given role attribute.
+func assertRole(APIstub shim.ChaincodeStubInterface, role string) error {
+	if err := assertAttribute(APIstub, "role", role); err != nil {
+		return fmt.Errorf("Submitter must have the %s role: %s", role, err.Error())
+	}
+	return nil
+}
+
+// assertPatient fails unless the submitter is the patient with the given user ID.
+func assertPatient(APIstub shim.ChaincodeStubInterface, userID string) error {
+	if err := assertRole(APIstub, "patient"); err != nil {
+		return err
+	}
+	if err := assertAttribute(APIstub, "userID", userID); err != nil {
+		return fmt.Errorf("Submitter is not patient %s", userID)
+	}
+	return nil
+}
+
+func getTxTime(APIstub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
+
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
 
@@ -501,108 +744,188 @@ func randSeq(n int) string {
 // getQueryResultForQueryString executes the passed in query string.
 // Result set is built and returned as a byte array containing the JSON results.
 // =========================================================================================
-func getQueryResultForQueryString(APIstub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+func getQueryResultForQueryString(APIstub shim.ChaincodeStubInterface, queryString string, opts resultSetOptions) ([]byte, error) {
 
-	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
 	resultsIterator, err := APIstub.GetQueryResult(queryString)
 	if err != nil {
 		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryRecords
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, err
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
-	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
-
-	return buffer.Bytes(), nil
+	return writeStateIterator(resultsIterator, opts)
 }
 
 // =========================================================================================
-// getQueryResultForQueryString executes the passed in query string.
+// getStateByPartialCompositeKey walks an index such as carditem~card and resolves
+// each entry to the record it points to.
 // Result set is built and returned as a byte array containing the JSON results.
 // =========================================================================================
-func getStateByPartialCompositeKey(APIstub shim.ChaincodeStubInterface, objectType string, keys []string) ([]byte, error) {
+func getStateByPartialCompositeKey(APIstub shim.ChaincodeStubInterface, objectType string, keys []string, opts resultSetOptions) ([]byte, error) {
 
-	fmt.Printf("- getQueryResultForobjectType objectType:\n%s\n", objectType)
 	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(objectType, keys)
 	if err != nil {
 		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryRecords
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-	var i int
-	bArrayMemberAlreadyWritten := false
-
-	for i = 0; resultsIterator.HasNext(); i++ {
-		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
+	writer := newResultSetWriter(opts)
+	for resultsIterator.HasNext() && !writer.Full() {
+		// Note that we don't use the index value, we'll just get the record key from the composite key
 		responseRange, err := resultsIterator.Next()
 		if err != nil {
 			return nil, err
 		}
 
-		// get the color and name from color~name composite key
 		_, compositeKeyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
 		if err != nil {
 			return nil, err
 		}
+		key := compositeKeyParts[len(compositeKeyParts)-1]
+
+		recordAsBytes, err := APIstub.GetState(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.Write(key, recordAsBytes); err != nil {
+			return nil, err
+		}
+	}
 
-		key := compositeKeyParts[1]
+	return writer.Bytes(), nil
+}
 
-		fmt.Printf("KEY: %s", key)
+// =========================================================================================
+// Result sets
+// Every query returns a JSON array of {"Key": ..., "Record": ...} objects. The records are
+// written straight into a single output buffer as they come off the iterator and are never
+// logged, since they may contain patient data.
+// =========================================================================================
 
-		bytes, _ := APIstub.GetState(key)
+// resultSetOptions controls how a result set is rendered.
+type resultSetOptions struct {
+	// MaxResults caps the number of array members written. Zero means no cap.
+	MaxResults int
+	// Fields, if set, projects each Record down to the listed top-level fields.
+	Fields []string
+}
 
-		//	cardItem := CardItem{}
-		//		json.Unmarshal(bytes, &cardItem)
+// parseResultSetOptions reads the optional trailing query arguments. An empty
+// maxResults means no cap and an empty field list means the whole record.
+func parseResultSetOptions(args []string) (resultSetOptions, error) {
+	//       0              1
+	// "maxResults", "field1,field2"
+	var opts resultSetOptions
 
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+	if len(args) > 2 {
+		return opts, fmt.Errorf("Incorrect number of arguments. Expecting at most 2 result options (maxResults, fields)")
+	}
+	if len(args) > 0 && args[0] != "" {
+		maxResults, err := strconv.Atoi(args[0])
+		if err != nil || maxResults < 0 {
+			return opts, fmt.Errorf("maxResults must be a non-negative numeric string")
+		}
+		opts.MaxResults = maxResults
+	}
+	if len(args) > 1 && args[1] != "" {
+		for _, field := range strings.Split(args[1], ",") {
+			field = strings.TrimSpace(field)
+			if field != "" {
+				opts.Fields = append(opts.Fields, field)
+			}
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(key)
-		buffer.WriteString("\"")
+	}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
+	return opts, nil
+}
 
-		//	b, _ := json.Marshal(cardItem)
-		buffer.WriteString(string(bytes))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+// resultSetWriter assembles the JSON array for a result set one member at a time.
+type resultSetWriter struct {
+	opts   resultSetOptions
+	buffer bytes.Buffer
+	count  int
+}
+
+func newResultSetWriter(opts resultSetOptions) *resultSetWriter {
+	writer := &resultSetWriter{opts: opts}
+	writer.buffer.WriteString("[")
+	return writer
+}
+
+// Full reports whether the writer has reached its MaxResults cap.
+func (w *resultSetWriter) Full() bool {
+	return w.opts.MaxResults > 0 && w.count >= w.opts.MaxResults
+}
+
+// Write appends a single {"Key", "Record"} member. Records are expected to be JSON
+// documents; a missing record is written as null.
+func (w *resultSetWriter) Write(key string, record []byte) error {
+	if w.Full() {
+		return nil
+	}
+
+	keyAsBytes, err := json.Marshal(key)
+	if err != nil {
+		return err
 	}
+	record, err = w.project(record)
+	if err != nil {
+		return fmt.Errorf("Failed to decode record %s: %s", key, err.Error())
+	}
+
+	// Add a comma before array members, suppress it for the first array member
+	if w.count > 0 {
+		w.buffer.WriteString(",")
+	}
+	w.buffer.WriteString("{\"Key\":")
+	w.buffer.Write(keyAsBytes)
+	w.buffer.WriteString(", \"Record\":")
+	w.buffer.Write(record)
+	w.buffer.WriteString("}")
+	w.count++
+
+	return nil
+}
 
-	buffer.WriteString("]")
+// Bytes closes the array and returns the result set.
+func (w *resultSetWriter) Bytes() []byte {
+	w.buffer.WriteString("]")
+	return w.buffer.Bytes()
+}
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+func (w *resultSetWriter) project(record []byte) ([]byte, error) {
+	if len(record) == 0 {
+		return []byte("null"), nil
+	}
+	if len(w.opts.Fields) == 0 {
+		// Record is a JSON object, so we write as-is
+		return record, nil
+	}
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(record, &document); err != nil {
+		return nil, err
+	}
+	projected := make(map[string]json.RawMessage, len(w.opts.Fields))
+	for _, field := range w.opts.Fields {
+		if value, ok := document[field]; ok {
+			projected[field] = value
+		}
+	}
+	return json.Marshal(projected)
+}
+
+// writeStateIterator drains a state iterator into a result set.
+func writeStateIterator(resultsIterator shim.StateQueryIteratorInterface, opts resultSetOptions) ([]byte, error) {
+	writer := newResultSetWriter(opts)
+	for resultsIterator.HasNext() && !writer.Full() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.Write(queryResponse.Key, queryResponse.Value); err != nil {
+			return nil, err
+		}
+	}
 
-	return buffer.Bytes(), nil
+	return writer.Bytes(), nil
 }
@@ -0,0 +1,255 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+/*
+ * Emergency ("break-glass") access to patient cards.
+ * A staff member outside the patient's clinic may read a card without consent, in two steps.
+ * grantBreakGlassAccess is submitted first: it leaves an access record on the ledger, emits
+ * a "breakGlassAccessGranted" event and opens a grant for that staff member and card that
+ * expires after breakGlassGrantDuration. breakGlassRead then only returns the card while a
+ * committed, unexpired grant exists for the submitter, so evaluating the grant without
+ * submitting it gives no access. Access records are keyed by the transaction that created
+ * them and are never updated or deleted.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// breakGlassGrantDuration is how long a break-glass grant allows its holder to read the card.
+const breakGlassGrantDuration = time.Hour
+
+type BreakGlassAccess struct {
+	Card          string    `json:"card"`
+	UserID        string    `json:"userID"`
+	Accessor      submitter `json:"accessor"`
+	Justification string    `json:"justification"`
+	TxID          string    `json:"txID"`
+	Timestamp     string    `json:"timestamp"`
+	ExpiresAt     string    `json:"expiresAt"`
+}
+
+// breakGlassResult is returned to the staff member: the grant the read was made under
+// followed by the card and its items.
+type breakGlassResult struct {
+	Access BreakGlassAccess `json:"access"`
+	Card   json.RawMessage  `json:"card"`
+	Items  json.RawMessage  `json:"items"`
+}
+
+func (s *SmartContract) grantBreakGlassAccess(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//    0              1
+	// "CARD0", "justification"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("A justification is required for break-glass access")
+	}
+
+	cardID := args[0]
+	accessor, card, err := assertBreakGlassAccessor(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	access := BreakGlassAccess{
+		Card:          cardID,
+		UserID:        card.UserID,
+		Accessor:      accessor,
+		Justification: args[1],
+		TxID:          APIstub.GetTxID(),
+		Timestamp:     txTime.Format(time.RFC3339),
+		ExpiresAt:     txTime.Add(breakGlassGrantDuration).Format(time.RFC3339),
+	}
+	accessAsBytes, err := json.Marshal(access)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Write the access record the patient sees ====
+	accessKey, err := APIstub.CreateCompositeKey("breakglass~user", []string{access.UserID, access.Card, access.TxID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := APIstub.GetState(accessKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil {
+		return shim.Error("Access record already exists for transaction " + access.TxID)
+	}
+	if err := APIstub.PutState(accessKey, accessAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Open the grant breakGlassRead checks, replacing any earlier one ====
+	grantKey, err := breakGlassGrantKey(APIstub, cardID, accessor)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.PutState(grantKey, accessAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.SetEvent("breakGlassAccessGranted", accessAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(accessAsBytes)
+}
+
+func (s *SmartContract) breakGlassRead(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//    0
+	// "CARD0"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	cardID := args[0]
+	accessor, _, err := assertBreakGlassAccessor(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Only a grant committed by an earlier transaction opens the card ====
+	grantKey, err := breakGlassGrantKey(APIstub, cardID, accessor)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	accessAsBytes, err := APIstub.GetState(grantKey)
+	if err != nil {
+		return shim.Error("Failed to get break-glass grant: " + err.Error())
+	} else if accessAsBytes == nil {
+		return shim.Error("No break-glass access has been granted for card " + cardID + ", submit grantBreakGlassAccess first")
+	}
+	access := BreakGlassAccess{}
+	if err := json.Unmarshal(accessAsBytes, &access); err != nil {
+		return shim.Error("Failed to decode break-glass grant: " + err.Error())
+	}
+
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	expiresAt, err := time.Parse(time.RFC3339, access.ExpiresAt)
+	if err != nil {
+		return shim.Error("Failed to decode break-glass grant expiry: " + err.Error())
+	}
+	if !txTime.Before(expiresAt) {
+		return shim.Error("Break-glass access to card " + cardID + " expired at " + access.ExpiresAt)
+	}
+
+	cardAsBytes, err := APIstub.GetState(cardID)
+	if err != nil {
+		return shim.Error("Failed to get card: " + err.Error())
+	}
+	items, err := getStateByPartialCompositeKey(APIstub, "carditem~card", []string{cardID}, resultSetOptions{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(breakGlassResult{Access: access, Card: cardAsBytes, Items: items})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
+
+// assertBreakGlassAccessor fails unless the submitter is staff of a clinic other than the
+// one that owns the card; the card's own clinic reads it through the normal queries.
+func assertBreakGlassAccessor(APIstub shim.ChaincodeStubInterface, cardID string) (submitter, *Card, error) {
+	if err := assertRole(APIstub, "staff"); err != nil {
+		return submitter{}, nil, err
+	}
+	accessor, err := getSubmitter(APIstub)
+	if err != nil {
+		return submitter{}, nil, err
+	}
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return submitter{}, nil, err
+	}
+	if accessor.MSPID == card.OrgMSPID {
+		return submitter{}, nil, fmt.Errorf("Staff of the clinic that owns card %s cannot use break-glass access", cardID)
+	}
+	return accessor, card, nil
+}
+
+func breakGlassGrantKey(APIstub shim.ChaincodeStubInterface, cardID string, accessor submitter) (string, error) {
+	return APIstub.CreateCompositeKey("breakglass~grant", []string{cardID, accessor.MSPID, accessor.ID})
+}
+
+func (s *SmartContract) queryBreakGlassAccesses(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//    0
+	// "USER0"
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	userID := args[0]
+	if err := assertPatient(APIstub, userID); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	opts, err := parseResultSetOptions(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("breakglass~user", []string{userID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// the access records are stored directly under the index key, so key each result by its transaction
+	writer := newResultSetWriter(opts)
+	for resultsIterator.HasNext() && !writer.Full() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := writer.Write(compositeKeyParts[len(compositeKeyParts)-1], queryResponse.Value); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return shim.Success(writer.Bytes())
+}
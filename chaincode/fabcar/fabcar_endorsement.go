@@ -0,0 +1,184 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+/*
+ * Key-level endorsement policies for patient cards.
+ * Each card and each of its items carries a state-based endorsement policy requiring a
+ * peer of the owning clinic's organization, so no other organization's peers can rewrite
+ * a patient's card on their own. Because the existing policy is checked when a write is
+ * validated, moving a card to another clinic must be endorsed by the current clinic's org;
+ * from then on only the new clinic's org can change it. A clinic is therefore only ever
+ * registered together with the MSP ID of its organization.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+func (s *SmartContract) transferCard(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//    0           1
+	// "CARD0", "COMPANY1"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	if err := assertRole(APIstub, "admin"); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cardID := args[0]
+	companyID := args[1]
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspID, err := getCompanyMSPID(APIstub, companyID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	card.CompanyID = companyID
+	card.OrgMSPID = mspID
+	cardAsBytes, err := json.Marshal(card)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.PutState(cardID, cardAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := setCardEndorsementPolicy(APIstub, cardID, card); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(cardAsBytes)
+}
+
+func (s *SmartContract) registerClinic(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//      0              1            2
+	// "COMPANY18", "Clinic name", "Org1MSP"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	if err := assertRole(APIstub, "admin"); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	companyID := args[0]
+	existing, err := APIstub.GetState(companyID)
+	if err != nil {
+		return shim.Error("Failed to get clinic: " + err.Error())
+	} else if existing != nil {
+		return shim.Error("Clinic already exists: " + companyID)
+	}
+
+	company := Company{Name: args[1], MSPID: args[2]}
+	companyAsBytes, err := putClinic(APIstub, companyID, company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(companyAsBytes)
+}
+
+// putClinic stores a clinic, refusing one without an organization: its cards could not be
+// given an endorsement policy.
+func putClinic(APIstub shim.ChaincodeStubInterface, companyID string, company Company) ([]byte, error) {
+	if company.MSPID == "" {
+		return nil, fmt.Errorf("Clinic %s must be registered with the MSP ID of its organization", companyID)
+	}
+	companyAsBytes, err := json.Marshal(company)
+	if err != nil {
+		return nil, err
+	}
+	if err := APIstub.PutState(companyID, companyAsBytes); err != nil {
+		return nil, err
+	}
+	return companyAsBytes, nil
+}
+
+func getCompanyMSPID(APIstub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	companyAsBytes, err := APIstub.GetState(companyID)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get clinic %s: %s", companyID, err.Error())
+	} else if companyAsBytes == nil {
+		return "", fmt.Errorf("Clinic does not exist: %s", companyID)
+	}
+
+	company := Company{}
+	if err := json.Unmarshal(companyAsBytes, &company); err != nil {
+		return "", fmt.Errorf("Failed to decode clinic %s: %s", companyID, err.Error())
+	}
+	if company.MSPID == "" {
+		return "", fmt.Errorf("Clinic %s has no organization", companyID)
+	}
+	return company.MSPID, nil
+}
+
+// cardEndorsementPolicy builds a policy that requires a peer of the given organization.
+func cardEndorsementPolicy(mspID string) ([]byte, error) {
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ep.AddOrgs(statebased.RoleTypePeer, mspID); err != nil {
+		return nil, err
+	}
+	return ep.Policy()
+}
+
+// setCardEndorsementPolicy applies the card's organization policy to the card and every
+// item in its chain.
+func setCardEndorsementPolicy(APIstub shim.ChaincodeStubInterface, cardID string, card *Card) error {
+	if card.OrgMSPID == "" {
+		return fmt.Errorf("Card %s has no owning organization", cardID)
+	}
+	policy, err := cardEndorsementPolicy(card.OrgMSPID)
+	if err != nil {
+		return err
+	}
+
+	if err := APIstub.SetStateValidationParameter(cardID, policy); err != nil {
+		return err
+	}
+	for seq := 0; seq < card.Length; seq++ {
+		if err := APIstub.SetStateValidationParameter(cardItemKey(cardID, seq), policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+/*
+ * Sharing de-identified card data with research consortia on another channel.
+ * An admin registers a research together with the chaincode and channel that receive its
+ * data. A patient enrolls one of their cards in a research, which records their consent to
+ * that target and assigns the card a pseudonymous subject ID for that research. Staff can
+ * then publish a snapshot of the card's items, stripped of the card ID and free-text notes,
+ * to the enrolled research chaincode with InvokeChaincode. The research chaincode can call back into
+ * queryResearchEnrollment to check that a subject is still enrolled.
+ *
+ * Note that Fabric treats a chaincode call to another channel as read-only: the research
+ * chaincode sees the snapshot and its response comes back here, but anything it writes
+ * is not committed on its own channel. The snapshot is therefore also emitted as a
+ * "researchSnapshotPublished" event so the consortium can ingest it on its own channel.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// researchSnapshotFunction is the function invoked on the research chaincode with a snapshot.
+const researchSnapshotFunction = "receiveSnapshot"
+
+type Research struct {
+	Name string `json:"name"`
+	// Chaincode and Channel are where the research's snapshots are published
+	Chaincode string `json:"chaincode"`
+	Channel   string `json:"channel"`
+}
+
+type ResearchEnrollment struct {
+	ResearchID string `json:"researchID"`
+	Card       string `json:"card"`
+	SubjectID  string `json:"subjectID"`
+	// Chaincode and Channel are copied from the research when the patient consents,
+	// so snapshots only ever go to the target the patient agreed to
+	Chaincode string `json:"chaincode"`
+	Channel   string `json:"channel"`
+	Consent   bool   `json:"consent"`
+	Timestamp string `json:"timestamp"`
+}
+
+// ResearchSnapshot is the de-identified view of a card that leaves this channel.
+type ResearchSnapshot struct {
+	ResearchID string                 `json:"researchID"`
+	SubjectID  string                 `json:"subjectID"`
+	Items      []ResearchSnapshotItem `json:"items"`
+	TxID       string                 `json:"txID"`
+	Timestamp  string                 `json:"timestamp"`
+}
+
+type ResearchSnapshotItem struct {
+	Seq   int    `json:"seq"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Date  string `json:"date"`
+}
+
+type researchEnrollmentStatus struct {
+	ResearchID string `json:"researchID"`
+	SubjectID  string `json:"subjectID"`
+	Enrolled   bool   `json:"enrolled"`
+}
+
+func (s *SmartContract) registerResearch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//      0             1               2                 3
+	// "RESEARCH0", "Research name", "researchcc", "researchchannel"
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	for i, arg := range args {
+		if len(arg) <= 0 {
+			return shim.Error(fmt.Sprintf("Argument %d must be a non-empty string", i+1))
+		}
+	}
+
+	if err := assertRole(APIstub, "admin"); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	researchID := args[0]
+	existing, err := APIstub.GetState(researchID)
+	if err != nil {
+		return shim.Error("Failed to get research: " + err.Error())
+	} else if existing != nil {
+		return shim.Error("Research already exists: " + researchID)
+	}
+
+	research := Research{Name: args[1], Chaincode: args[2], Channel: args[3]}
+	researchAsBytes, err := json.Marshal(research)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.PutState(researchID, researchAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(researchAsBytes)
+}
+
+func (s *SmartContract) enrollInResearch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//      0          1
+	// "RESEARCH0", "CARD0"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	researchID := args[0]
+	cardID := args[1]
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := assertPatient(APIstub, card.UserID); err != nil {
+		return shim.Error(err.Error())
+	}
+	research, err := getResearch(APIstub, researchID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	enrollment, err := getResearchEnrollment(APIstub, researchID, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if enrollment == nil {
+		// The subject ID is salted with the enrolling transaction so that it cannot be
+		// recomputed from the card ID alone
+		subjectHash := sha256.Sum256([]byte(APIstub.GetTxID() + "~" + researchID + "~" + cardID))
+		enrollment = &ResearchEnrollment{ResearchID: researchID, Card: cardID, SubjectID: hex.EncodeToString(subjectHash[:])}
+
+		subjectIndexKey, err := APIstub.CreateCompositeKey("enrollment~research~subject~card", []string{researchID, enrollment.SubjectID, cardID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := APIstub.PutState(subjectIndexKey, []byte{0x00}); err != nil {
+			return shim.Error(err.Error())
+		}
+	} else if enrollment.Consent {
+		return shim.Error("Card " + cardID + " is already enrolled in " + researchID)
+	}
+
+	enrollment.Chaincode = research.Chaincode
+	enrollment.Channel = research.Channel
+	return putResearchEnrollment(APIstub, enrollment, true)
+}
+
+func (s *SmartContract) withdrawFromResearch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//      0          1
+	// "RESEARCH0", "CARD0"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	researchID := args[0]
+	cardID := args[1]
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := assertPatient(APIstub, card.UserID); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	enrollment, err := getResearchEnrollment(APIstub, researchID, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if enrollment == nil || !enrollment.Consent {
+		return shim.Error("Card " + cardID + " is not enrolled in " + researchID)
+	}
+
+	// the enrollment is kept with consent withdrawn, so the subject ID is never reassigned
+	return putResearchEnrollment(APIstub, enrollment, false)
+}
+
+func (s *SmartContract) publishToResearch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//      0          1
+	// "RESEARCH0", "CARD0"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	for i, arg := range args {
+		if len(arg) <= 0 {
+			return shim.Error(fmt.Sprintf("Argument %d must be a non-empty string", i+1))
+		}
+	}
+
+	researchID := args[0]
+	cardID := args[1]
+
+	if err := assertRole(APIstub, "staff"); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	enrollment, err := getResearchEnrollment(APIstub, researchID, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if enrollment == nil || !enrollment.Consent {
+		return shim.Error("Patient has not consented to share card " + cardID + " with " + researchID)
+	}
+	if enrollment.Chaincode == "" || enrollment.Channel == "" {
+		return shim.Error("Enrollment of card " + cardID + " in " + researchID + " has no research chaincode")
+	}
+
+	card, err := getCard(APIstub, cardID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Build the de-identified snapshot by walking the card's chain ====
+	snapshot := ResearchSnapshot{
+		ResearchID: researchID,
+		SubjectID:  enrollment.SubjectID,
+		Items:      []ResearchSnapshotItem{},
+		TxID:       APIstub.GetTxID(),
+		Timestamp:  txTime.Format(time.RFC3339),
+	}
+	for seq := 0; seq < card.Length; seq++ {
+		cardItemAsBytes, err := APIstub.GetState(cardItemKey(cardID, seq))
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if cardItemAsBytes == nil {
+			continue
+		}
+		cardItem := CardItem{}
+		if err := json.Unmarshal(cardItemAsBytes, &cardItem); err != nil {
+			return shim.Error(err.Error())
+		}
+		snapshot.Items = append(snapshot.Items, ResearchSnapshotItem{Seq: cardItem.Seq, Key: cardItem.Key, Value: cardItem.Value, Date: cardItem.Date})
+	}
+	snapshotAsBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Hand the snapshot to the research chaincode the patient consented to ====
+	response := APIstub.InvokeChaincode(enrollment.Chaincode, [][]byte{[]byte(researchSnapshotFunction), snapshotAsBytes}, enrollment.Channel)
+	if response.Status != shim.OK {
+		return shim.Error(fmt.Sprintf("Failed to publish to research chaincode %s on channel %s: %s", enrollment.Chaincode, enrollment.Channel, response.Message))
+	}
+
+	if err := APIstub.SetEvent("researchSnapshotPublished", snapshotAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(snapshotAsBytes)
+}
+
+// queryResearchEnrollment is the read path for research chaincodes. It only confirms
+// whether a subject is currently enrolled and never reveals which card it stands for.
+func (s *SmartContract) queryResearchEnrollment(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	//      0            1
+	// "RESEARCH0", "subjectID"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	researchID := args[0]
+	subjectID := args[1]
+	status := researchEnrollmentStatus{ResearchID: researchID, SubjectID: subjectID}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey("enrollment~research~subject~card", []string{researchID, subjectID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	if resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		enrollment, err := getResearchEnrollment(APIstub, researchID, compositeKeyParts[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		status.Enrolled = enrollment != nil && enrollment.Consent
+	}
+
+	statusAsBytes, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusAsBytes)
+}
+
+func getResearch(APIstub shim.ChaincodeStubInterface, researchID string) (*Research, error) {
+	researchAsBytes, err := APIstub.GetState(researchID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get research %s: %s", researchID, err.Error())
+	} else if researchAsBytes == nil {
+		return nil, fmt.Errorf("Research does not exist: %s", researchID)
+	}
+
+	research := &Research{}
+	if err := json.Unmarshal(researchAsBytes, research); err != nil {
+		return nil, fmt.Errorf("Failed to decode research %s: %s", researchID, err.Error())
+	}
+	return research, nil
+}
+
+func researchEnrollmentKey(APIstub shim.ChaincodeStubInterface, researchID string, cardID string) (string, error) {
+	return APIstub.CreateCompositeKey("enrollment~research~card", []string{researchID, cardID})
+}
+
+// getResearchEnrollment returns nil if the card has never been enrolled in the research.
+func getResearchEnrollment(APIstub shim.ChaincodeStubInterface, researchID string, cardID string) (*ResearchEnrollment, error) {
+	key, err := researchEnrollmentKey(APIstub, researchID, cardID)
+	if err != nil {
+		return nil, err
+	}
+	enrollmentAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get enrollment: %s", err.Error())
+	} else if enrollmentAsBytes == nil {
+		return nil, nil
+	}
+
+	enrollment := &ResearchEnrollment{}
+	if err := json.Unmarshal(enrollmentAsBytes, enrollment); err != nil {
+		return nil, fmt.Errorf("Failed to decode enrollment: %s", err.Error())
+	}
+	return enrollment, nil
+}
+
+func putResearchEnrollment(APIstub shim.ChaincodeStubInterface, enrollment *ResearchEnrollment, consent bool) sc.Response {
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	enrollment.Consent = consent
+	enrollment.Timestamp = txTime.Format(time.RFC3339)
+
+	key, err := researchEnrollmentKey(APIstub, enrollment.ResearchID, enrollment.Card)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	enrollmentAsBytes, err := json.Marshal(enrollment)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.PutState(key, enrollmentAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(enrollmentAsBytes)
+}
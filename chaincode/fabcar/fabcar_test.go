@@ -0,0 +1,541 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+var (
+	// clinic staff of the organization that owns the test cards
+	doctor = submitter{MSPID: "Org1MSP", ID: "doctor's id"}
+	// staff of another clinic, who can only use break-glass access
+	paramedic = submitter{MSPID: "Org2MSP", ID: "paramedic's id"}
+	nurse     = submitter{MSPID: "Org2MSP", ID: "nurse's id"}
+	// the patient USER0
+	patient = submitter{MSPID: "Org1MSP", ID: "patient's id"}
+
+	staffRole   = map[string]string{"role": "staff"}
+	patientRole = map[string]string{"role": "patient", "userID": "USER0"}
+)
+
+// testIdentity stands in for the certificate of the submitter
+type testIdentity struct {
+	identity   submitter
+	attributes map[string]string
+}
+
+func (ti *testIdentity) GetID() (string, error) {
+	return ti.identity.ID, nil
+}
+
+func (ti *testIdentity) GetMSPID() (string, error) {
+	return ti.identity.MSPID, nil
+}
+
+func (ti *testIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := ti.attributes[attrName]
+	return value, found, nil
+}
+
+func (ti *testIdentity) AssertAttributeValue(attrName, attrValue string) error {
+	value, found := ti.attributes[attrName]
+	if !found || value != attrValue {
+		return fmt.Errorf("attribute %s is not %s", attrName, attrValue)
+	}
+	return nil
+}
+
+func (ti *testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// setSubmitter makes identity the submitter of the following transactions
+func setSubmitter(identity submitter, attributes map[string]string) {
+	newClientIdentity = func(APIstub shim.ChaincodeStubInterface) (cid.ClientIdentity, error) {
+		return &testIdentity{identity: identity, attributes: attributes}, nil
+	}
+}
+
+// newCardStub returns a stub holding CARD0 of patient USER0 at the doctor's clinic,
+// with the given number of items
+func newCardStub(t *testing.T, items int) *shim.MockStub {
+	setSubmitter(doctor, staffRole)
+	stub := shim.NewMockStub("fabcar", new(SmartContract))
+
+	stub.MockTransactionStart("init")
+	card := Card{UserID: "USER0", CompanyID: "COMPANY0", Name: "Карточка", OrgMSPID: doctor.MSPID}
+	for i := 0; i < items; i++ {
+		cardItem := CardItem{Key: "Принятие таблетки " + fmt.Sprint(i), Value: "1", Date: "2017.06.18"}
+		if _, err := appendCardItem(stub, "CARD0", &card, &cardItem); err != nil {
+			fmt.Println("Failed to add card item", err)
+			t.FailNow()
+		}
+	}
+	if items == 0 {
+		cardAsBytes, _ := json.Marshal(card)
+		stub.PutState("CARD0", cardAsBytes)
+	}
+	stub.MockTransactionEnd("init")
+	return stub
+}
+
+func invoke(stub *shim.MockStub, args ...string) (int32, string, []byte) {
+	var byteArgs [][]byte
+	for _, arg := range args {
+		byteArgs = append(byteArgs, []byte(arg))
+	}
+	res := stub.MockInvoke("1", byteArgs)
+	return res.Status, res.Message, res.Payload
+}
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args ...string) []byte {
+	status, message, payload := invoke(stub, args...)
+	if status != shim.OK {
+		fmt.Println("Invoke", args, "failed", message)
+		t.FailNow()
+	}
+	return payload
+}
+
+func checkInvokeFails(t *testing.T, stub *shim.MockStub, expectedMessage string, args ...string) {
+	status, message, _ := invoke(stub, args...)
+	if status == shim.OK {
+		fmt.Println("Invoke", args, "should have failed")
+		t.FailNow()
+	}
+	if !strings.Contains(message, expectedMessage) {
+		fmt.Println("Invoke", args, "failed with", message, "not", expectedMessage)
+		t.FailNow()
+	}
+}
+
+// checkEvent drains the stub's events and checks the last one has the given name
+func checkEvent(t *testing.T, stub *shim.MockStub, name string) []byte {
+	var payload []byte
+	found := ""
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		event := <-stub.ChaincodeEventsChannel
+		found, payload = event.EventName, event.Payload
+	}
+	if found != name {
+		fmt.Println("Event was", found, "not", name)
+		t.FailNow()
+	}
+	return payload
+}
+
+func TestFabcar_BreakGlassGrant(t *testing.T) {
+	stub := newCardStub(t, 2)
+
+	// only staff may open a card, and never the card's own clinic
+	setSubmitter(paramedic, patientRole)
+	checkInvokeFails(t, stub, "must have the staff role", "grantBreakGlassAccess", "CARD0", "unconscious patient")
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "clinic that owns card CARD0", "grantBreakGlassAccess", "CARD0", "unconscious patient")
+	setSubmitter(paramedic, staffRole)
+	checkInvokeFails(t, stub, "justification is required", "grantBreakGlassAccess", "CARD0", "")
+	checkInvokeFails(t, stub, "Card does not exist", "grantBreakGlassAccess", "CARD1", "unconscious patient")
+
+	payload := checkInvoke(t, stub, "grantBreakGlassAccess", "CARD0", "unconscious patient")
+	access := BreakGlassAccess{}
+	if err := json.Unmarshal(payload, &access); err != nil {
+		fmt.Println("Grant is not valid JSON", string(payload))
+		t.FailNow()
+	}
+	if access.Card != "CARD0" || access.UserID != "USER0" || access.Accessor != paramedic || access.TxID != "1" {
+		fmt.Println("Grant was", string(payload))
+		t.FailNow()
+	}
+	granted, _ := time.Parse(time.RFC3339, access.Timestamp)
+	expiresAt, _ := time.Parse(time.RFC3339, access.ExpiresAt)
+	if expiresAt.Sub(granted) != breakGlassGrantDuration {
+		fmt.Println("Grant expires at", access.ExpiresAt, "not an hour after", access.Timestamp)
+		t.FailNow()
+	}
+	if string(checkEvent(t, stub, "breakGlassAccessGranted")) != string(payload) {
+		fmt.Println("Event does not carry the access record")
+		t.FailNow()
+	}
+
+	// the patient sees the access record
+	setSubmitter(patient, patientRole)
+	payload = checkInvoke(t, stub, "queryBreakGlassAccesses", "USER0")
+	if !strings.Contains(string(payload), `"Key":"1"`) || !strings.Contains(string(payload), "unconscious patient") {
+		fmt.Println("Access records were", string(payload))
+		t.FailNow()
+	}
+}
+
+func TestFabcar_BreakGlassRead(t *testing.T) {
+	stub := newCardStub(t, 2)
+
+	// evaluating the grant without submitting it leaves nothing to read under
+	setSubmitter(paramedic, staffRole)
+	checkInvokeFails(t, stub, "No break-glass access has been granted", "breakGlassRead", "CARD0")
+
+	checkInvoke(t, stub, "grantBreakGlassAccess", "CARD0", "unconscious patient")
+	payload := checkInvoke(t, stub, "breakGlassRead", "CARD0")
+	result := breakGlassResult{}
+	if err := json.Unmarshal(payload, &result); err != nil {
+		fmt.Println("Read is not valid JSON", string(payload))
+		t.FailNow()
+	}
+	if result.Access.Accessor != paramedic || !strings.Contains(string(result.Card), `"userID":"USER0"`) {
+		fmt.Println("Read was", string(payload))
+		t.FailNow()
+	}
+	items := []json.RawMessage{}
+	if err := json.Unmarshal(result.Items, &items); err != nil || len(items) != 2 {
+		fmt.Println("Read returned items", string(result.Items))
+		t.FailNow()
+	}
+}
+
+func TestFabcar_BreakGlassReadRefused(t *testing.T) {
+	stub := newCardStub(t, 2)
+	setSubmitter(paramedic, staffRole)
+	checkInvoke(t, stub, "grantBreakGlassAccess", "CARD0", "unconscious patient")
+
+	// the grant belongs to the paramedic alone
+	setSubmitter(nurse, staffRole)
+	checkInvokeFails(t, stub, "No break-glass access has been granted", "breakGlassRead", "CARD0")
+	setSubmitter(paramedic, patientRole)
+	checkInvokeFails(t, stub, "must have the staff role", "breakGlassRead", "CARD0")
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "clinic that owns card CARD0", "breakGlassRead", "CARD0")
+
+	// and it runs out
+	setSubmitter(paramedic, staffRole)
+	grantKey, _ := stub.CreateCompositeKey("breakglass~grant", []string{"CARD0", paramedic.MSPID, paramedic.ID})
+	access := BreakGlassAccess{}
+	json.Unmarshal(stub.State[grantKey], &access)
+	access.ExpiresAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	stub.State[grantKey], _ = json.Marshal(access)
+	checkInvokeFails(t, stub, "expired", "breakGlassRead", "CARD0")
+}
+
+// researchChaincode records the snapshots published to it
+type researchChaincode struct {
+	snapshots []ResearchSnapshot
+}
+
+func (rc *researchChaincode) Init(stub shim.ChaincodeStubInterface) sc.Response {
+	return shim.Success(nil)
+}
+
+func (rc *researchChaincode) Invoke(stub shim.ChaincodeStubInterface) sc.Response {
+	function, args := stub.GetFunctionAndParameters()
+	if function != researchSnapshotFunction || len(args) != 1 {
+		return shim.Error("unexpected call " + function)
+	}
+	snapshot := ResearchSnapshot{}
+	if err := json.Unmarshal([]byte(args[0]), &snapshot); err != nil {
+		return shim.Error(err.Error())
+	}
+	rc.snapshots = append(rc.snapshots, snapshot)
+	return shim.Success(nil)
+}
+
+func TestFabcar_PublishToResearch(t *testing.T) {
+	stub := newCardStub(t, 3)
+	research := &researchChaincode{}
+	stub.MockPeerChaincode("researchcc/research", shim.NewMockStub("researchcc", research))
+	other := &researchChaincode{}
+	stub.MockPeerChaincode("othercc/research", shim.NewMockStub("othercc", other))
+
+	// only admins register researches, and the target is fixed from then on
+	checkInvokeFails(t, stub, "must have the admin role", "registerResearch", "RESEARCH0", "Исследование 1", "researchcc", "research")
+	setSubmitter(doctor, map[string]string{"role": "admin"})
+	checkInvoke(t, stub, "registerResearch", "RESEARCH0", "Исследование 1", "researchcc", "research")
+	checkInvoke(t, stub, "registerResearch", "RESEARCH1", "Исследование 2", "othercc", "research")
+	checkInvokeFails(t, stub, "Research already exists", "registerResearch", "RESEARCH0", "Исследование 1", "othercc", "research")
+
+	setSubmitter(patient, patientRole)
+	checkInvokeFails(t, stub, "Research does not exist", "enrollInResearch", "RESEARCH2", "CARD0")
+	payload := checkInvoke(t, stub, "enrollInResearch", "RESEARCH0", "CARD0")
+	enrollment := ResearchEnrollment{}
+	json.Unmarshal(payload, &enrollment)
+	if enrollment.Chaincode != "researchcc" || enrollment.Channel != "research" || !enrollment.Consent {
+		fmt.Println("Enrollment was", string(payload))
+		t.FailNow()
+	}
+
+	// staff cannot pick the target any more
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "Expecting 2", "publishToResearch", "RESEARCH0", "CARD0", "othercc", "research")
+	checkInvokeFails(t, stub, "has not consented", "publishToResearch", "RESEARCH1", "CARD0")
+	checkInvoke(t, stub, "publishToResearch", "RESEARCH0", "CARD0")
+	checkEvent(t, stub, "researchSnapshotPublished")
+
+	if len(other.snapshots) != 0 || len(research.snapshots) != 1 {
+		fmt.Println("Snapshots went to", len(research.snapshots), "and", len(other.snapshots))
+		t.FailNow()
+	}
+	snapshot := research.snapshots[0]
+	if snapshot.ResearchID != "RESEARCH0" || snapshot.SubjectID != enrollment.SubjectID || len(snapshot.Items) != 3 {
+		fmt.Println("Snapshot was", snapshot)
+		t.FailNow()
+	}
+
+	// withdrawing consent stops publishing
+	setSubmitter(patient, patientRole)
+	checkInvoke(t, stub, "withdrawFromResearch", "RESEARCH0", "CARD0")
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "has not consented", "publishToResearch", "RESEARCH0", "CARD0")
+}
+
+// checkEndorsementPolicy checks the key can only be endorsed by peers of mspID
+func checkEndorsementPolicy(t *testing.T, stub *shim.MockStub, key string, mspID string) {
+	expected, _ := cardEndorsementPolicy(mspID)
+	policy, _ := stub.GetStateValidationParameter(key)
+	if string(policy) != string(expected) {
+		fmt.Println("Endorsement policy of", key, "is not", mspID)
+		t.FailNow()
+	}
+}
+
+func TestFabcar_InitLedger(t *testing.T) {
+	stub := newCardStub(t, 0)
+
+	// the clinics' organization has to be given, there is no default
+	checkInvokeFails(t, stub, "Expecting the MSP ID", "initLedger")
+	checkInvokeFails(t, stub, "must be registered with the MSP ID", "initLedger", "")
+	checkInvoke(t, stub, "initLedger", "Org3MSP")
+
+	company := Company{}
+	json.Unmarshal(stub.State["COMPANY17"], &company)
+	if company.MSPID != "Org3MSP" {
+		fmt.Println("COMPANY17 was", string(stub.State["COMPANY17"]))
+		t.FailNow()
+	}
+	checkEndorsementPolicy(t, stub, "CARD19", "Org3MSP")
+	checkEndorsementPolicy(t, stub, cardItemKey("CARD19", 19), "Org3MSP")
+}
+
+func TestFabcar_RegisterClinic(t *testing.T) {
+	stub := newCardStub(t, 0)
+	admin := map[string]string{"role": "admin"}
+
+	checkInvokeFails(t, stub, "must have the admin role", "registerClinic", "COMPANY18", "Клиника", "Org2MSP")
+	setSubmitter(doctor, admin)
+	checkInvokeFails(t, stub, "Expecting 3", "registerClinic", "COMPANY18", "Клиника")
+	checkInvokeFails(t, stub, "must be registered with the MSP ID", "registerClinic", "COMPANY18", "Клиника", "")
+	checkInvoke(t, stub, "registerClinic", "COMPANY18", "Клиника", "Org2MSP")
+	checkInvokeFails(t, stub, "Clinic already exists", "registerClinic", "COMPANY18", "Клиника", "Org1MSP")
+
+	if string(stub.State["COMPANY18"]) != `{"name":"Клиника","mspID":"Org2MSP"}` {
+		fmt.Println("COMPANY18 was", string(stub.State["COMPANY18"]))
+		t.FailNow()
+	}
+}
+
+func TestFabcar_TransferCard(t *testing.T) {
+	stub := newCardStub(t, 2)
+	admin := map[string]string{"role": "admin"}
+	setSubmitter(doctor, admin)
+	checkInvoke(t, stub, "registerClinic", "COMPANY18", "Клиника", "Org2MSP")
+	stub.State["COMPANY19"] = []byte(`{"name":"Клиника без организации"}`)
+
+	// moving a card is for admins only
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "must have the admin role", "transferCard", "CARD0", "COMPANY18")
+	setSubmitter(doctor, admin)
+	checkInvokeFails(t, stub, "Clinic does not exist", "transferCard", "CARD0", "COMPANY20")
+	checkInvokeFails(t, stub, "has no organization", "transferCard", "CARD0", "COMPANY19")
+
+	checkInvoke(t, stub, "transferCard", "CARD0", "COMPANY18")
+	card, _ := getCard(stub, "CARD0")
+	if card.CompanyID != "COMPANY18" || card.OrgMSPID != "Org2MSP" {
+		fmt.Println("CARD0 was", string(stub.State["CARD0"]))
+		t.FailNow()
+	}
+	checkEndorsementPolicy(t, stub, "CARD0", "Org2MSP")
+	checkEndorsementPolicy(t, stub, cardItemKey("CARD0", 1), "Org2MSP")
+
+	// from now on the new clinic writes the card
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "Only staff of the clinic that owns card CARD0", "addCardItem", "CARD0", "Анализ", "1", "", "2017.06.19")
+	setSubmitter(paramedic, staffRole)
+	checkInvoke(t, stub, "addCardItem", "CARD0", "Анализ", "1", "", "2017.06.19")
+	checkEndorsementPolicy(t, stub, cardItemKey("CARD0", 2), "Org2MSP")
+}
+
+func TestFabcar_AddCardItem(t *testing.T) {
+	stub := newCardStub(t, 1)
+
+	// only the owning clinic's staff may write to a card
+	setSubmitter(patient, patientRole)
+	checkInvokeFails(t, stub, "must have the staff role", "addCardItem", "CARD0", "Анализ", "1", "", "2017.06.19")
+	setSubmitter(paramedic, staffRole)
+	checkInvokeFails(t, stub, "Only staff of the clinic that owns card CARD0", "addCardItem", "CARD0", "Анализ", "1", "", "2017.06.19")
+	setSubmitter(doctor, staffRole)
+	checkInvokeFails(t, stub, "Card does not exist", "addCardItem", "CARD1", "Анализ", "1", "", "2017.06.19")
+
+	payload := checkInvoke(t, stub, "addCardItem", "CARD0", "Анализ", "1", "", "2017.06.19")
+	if string(payload) != cardItemKey("CARD0", 1) {
+		fmt.Println("Item was added as", string(payload))
+		t.FailNow()
+	}
+	checkEndorsementPolicy(t, stub, cardItemKey("CARD0", 1), doctor.MSPID)
+
+	// a card without an organization cannot take items
+	stub.State["CARD1"] = []byte(`{"userID":"USER0","companyID":"COMPANY0","name":"Карточка"}`)
+	setSubmitter(submitter{ID: "doctor's id"}, staffRole)
+	checkInvokeFails(t, stub, "Card CARD1 has no owning organization", "addCardItem", "CARD1", "Анализ", "1", "", "2017.06.19")
+}
+
+type resultSetMember struct {
+	Key    string
+	Record map[string]json.RawMessage
+}
+
+func checkResultSet(t *testing.T, payload []byte, keys ...string) []resultSetMember {
+	var members []resultSetMember
+	if err := json.Unmarshal(payload, &members); err != nil {
+		fmt.Println("Result set is not valid JSON", string(payload))
+		t.FailNow()
+	}
+	if len(members) != len(keys) {
+		fmt.Println("Result set was", string(payload), "not", keys)
+		t.FailNow()
+	}
+	for i, key := range keys {
+		if members[i].Key != key {
+			fmt.Println("Result set was", string(payload), "not", keys)
+			t.FailNow()
+		}
+	}
+	return members
+}
+
+func TestFabcar_QueryCardItems(t *testing.T) {
+	stub := newCardStub(t, 3)
+
+	payload := checkInvoke(t, stub, "queryCardItemByCARDID", "CARD0")
+	checkResultSet(t, payload, cardItemKey("CARD0", 0), cardItemKey("CARD0", 1), cardItemKey("CARD0", 2))
+
+	// capped and projected
+	payload = checkInvoke(t, stub, "queryCardItemByCARDID", "CARD0", "2", "seq, key")
+	members := checkResultSet(t, payload, cardItemKey("CARD0", 0), cardItemKey("CARD0", 1))
+	if len(members[1].Record) != 2 || string(members[1].Record["seq"]) != "1" || string(members[1].Record["key"]) != `"Принятие таблетки 1"` {
+		fmt.Println("Result set was", string(payload))
+		t.FailNow()
+	}
+
+	checkInvokeFails(t, stub, "maxResults must be a non-negative numeric string", "queryCardItemByCARDID", "CARD0", "-1")
+	checkInvokeFails(t, stub, "at most 2 result options", "queryCardItemByCARDID", "CARD0", "1", "key", "seq")
+}
+
+func TestFabcar_ResultSetWriter(t *testing.T) {
+	writer := newResultSetWriter(resultSetOptions{MaxResults: 2})
+	writer.Write(`USER"0`, []byte(`{"firstName":"Pavel"}`))
+	writer.Write("USER1", nil)
+	writer.Write("USER2", []byte(`{"firstName":"Maksim"}`))
+	if !writer.Full() {
+		fmt.Println("Writer should be full")
+		t.FailNow()
+	}
+
+	// keys are escaped and a missing record is null
+	members := checkResultSet(t, writer.Bytes(), `USER"0`, "USER1")
+	if members[1].Record != nil {
+		fmt.Println("Missing record was", members[1].Record)
+		t.FailNow()
+	}
+}
+
+func checkChainReport(t *testing.T, stub *shim.MockStub, valid bool, brokenAt *cardChainBreak) {
+	payload := checkInvoke(t, stub, "verifyCardChain", "CARD0")
+	report := cardChainReport{}
+	if err := json.Unmarshal(payload, &report); err != nil {
+		fmt.Println("Report is not valid JSON", string(payload))
+		t.FailNow()
+	}
+	if report.Card != "CARD0" || report.Valid != valid || (brokenAt == nil) != (report.BrokenAt == nil) || (brokenAt != nil && *brokenAt != *report.BrokenAt) {
+		fmt.Println("Report was", string(payload), "not", valid, brokenAt)
+		t.FailNow()
+	}
+}
+
+func TestFabcar_VerifyCardChain(t *testing.T) {
+	stub := newCardStub(t, 3)
+	checkChainReport(t, stub, true, nil)
+
+	// items added later extend the chain
+	checkInvoke(t, stub, "addCardItem", "CARD0", "Анализ", "1", "", "2017.06.19")
+	checkChainReport(t, stub, true, nil)
+	checkInvokeFails(t, stub, "Card does not exist", "verifyCardChain", "CARD1")
+
+	// a tampered item breaks the link to the next one
+	item1 := stub.State[cardItemKey("CARD0", 1)]
+	stub.State[cardItemKey("CARD0", 1)] = []byte(strings.Replace(string(item1), `"value":"1"`, `"value":"2"`, 1))
+	checkChainReport(t, stub, false, &cardChainBreak{Seq: 2, Key: cardItemKey("CARD0", 2), Reason: "previous hash does not match"})
+	stub.State[cardItemKey("CARD0", 1)] = item1
+	checkChainReport(t, stub, true, nil)
+
+	// and a tampered last item no longer matches the card's head
+	item3 := stub.State[cardItemKey("CARD0", 3)]
+	stub.State[cardItemKey("CARD0", 3)] = []byte(strings.Replace(string(item3), `"value":"1"`, `"value":"2"`, 1))
+	checkChainReport(t, stub, false, &cardChainBreak{Seq: 3, Key: cardItemKey("CARD0", 3), Reason: "card head does not match the last item"})
+	stub.State[cardItemKey("CARD0", 3)] = item3
+
+	// items cannot be moved around or removed
+	item0 := stub.State[cardItemKey("CARD0", 0)]
+	stub.State[cardItemKey("CARD0", 0)] = item1
+	checkChainReport(t, stub, false, &cardChainBreak{Seq: 0, Key: cardItemKey("CARD0", 0), Reason: "item does not belong at this position"})
+	stub.State[cardItemKey("CARD0", 0)] = []byte("not json")
+	checkChainReport(t, stub, false, &cardChainBreak{Seq: 0, Key: cardItemKey("CARD0", 0), Reason: "item cannot be decoded"})
+	stub.State[cardItemKey("CARD0", 0)] = item0
+	delete(stub.State, cardItemKey("CARD0", 2))
+	checkChainReport(t, stub, false, &cardChainBreak{Seq: 2, Key: cardItemKey("CARD0", 2), Reason: "item is missing"})
+}
+
+func TestFabcar_QueryBreakGlassAccesses(t *testing.T) {
+	stub := newCardStub(t, 1)
+	setSubmitter(paramedic, staffRole)
+	checkInvoke(t, stub, "grantBreakGlassAccess", "CARD0", "unconscious patient")
+
+	// only the patient lists the accesses to their cards
+	checkInvokeFails(t, stub, "must have the patient role", "queryBreakGlassAccesses", "USER0")
+	setSubmitter(patient, map[string]string{"role": "patient", "userID": "USER1"})
+	checkInvokeFails(t, stub, "is not patient USER0", "queryBreakGlassAccesses", "USER0")
+	payload := checkInvoke(t, stub, "queryBreakGlassAccesses", "USER1")
+	checkResultSet(t, payload)
+
+	setSubmitter(patient, patientRole)
+	payload = checkInvoke(t, stub, "queryBreakGlassAccesses", "USER0")
+	checkResultSet(t, payload, "1")
+	payload = checkInvoke(t, stub, "queryBreakGlassAccesses", "USER0", "", "justification")
+	members := checkResultSet(t, payload, "1")
+	if len(members[0].Record) != 1 || string(members[0].Record["justification"]) != `"unconscious patient"` {
+		fmt.Println("Result set was", string(payload))
+		t.FailNow()
+	}
+}
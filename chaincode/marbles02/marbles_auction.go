@@ -0,0 +1,625 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble auctions ====================================================================
+// The owner of a marble can sell it in a sealed-bid auction, which moves through three
+// phases:
+//   bidding   - openAuction. Bidders commit to a bid with submitBid. Only a hash of the
+//               bid is stored; the price and a secret salt are passed in the transient
+//               map under "bid" ({"price":50,"salt":"..."}) and never reach the ledger.
+//   revealing - startReveal. Bidders open their bids with revealBid, passing the same
+//               price and salt, which must hash to the commitment made while bidding.
+//   closed    - closeAuction. The marble goes to the highest revealed bid at or above
+//               the reserve price, unless the winner already has as many marbles as
+//               the config allows. Payment is settled off-chain.
+// openAuction sets a deadline for bidding and one for revealing, checked against the
+// transaction timestamp. The seller may end a phase early; once its deadline has passed
+// anyone can move the auction on, so a seller cannot hold it open. If no one started the
+// reveal phase before the reveal deadline, the auction can be closed straight away.
+// From openAuction until closeAuction the marble is locked: it cannot be transferred,
+// traded, updated, put in escrow, burned or deleted.
+// =========================================================================================
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	auctionBidding   = "bidding"
+	auctionRevealing = "revealing"
+	auctionClosed    = "closed"
+
+	// minBidSaltLength keeps commitments from being brute forced over the range of prices
+	minBidSaltLength = 16
+
+	// default length of the bidding and reveal phases, in seconds
+	defaultBiddingPeriod = 24 * 60 * 60
+	defaultRevealPeriod  = 24 * 60 * 60
+)
+
+type marbleAuction struct {
+	ObjectType     string         `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	ID             string         `json:"id"`
+	Marble         string         `json:"marble"`
+	Seller         string         `json:"seller"`
+	SellerIdentity marbleIdentity `json:"sellerIdentity"`
+	ReservePrice   int            `json:"reservePrice"`
+	Status         string         `json:"status"`
+	BiddingEnds    int64          `json:"biddingEnds"` //unix seconds, compared with the transaction timestamp
+	RevealEnds     int64          `json:"revealEnds"`  //unix seconds, compared with the transaction timestamp
+
+	// set by closeAuction. Winner is empty if there was no valid bid
+	Winner         string         `json:"winner,omitempty"`
+	WinnerIdentity marbleIdentity `json:"winnerIdentity"`
+	WinningPrice   int            `json:"winningPrice,omitempty"`
+	Outcome        string         `json:"outcome,omitempty"`
+}
+
+type marbleBid struct {
+	ObjectType     string         `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	AuctionID      string         `json:"auctionID"`
+	Bidder         string         `json:"bidder"`
+	BidderIdentity marbleIdentity `json:"bidderIdentity"`
+	Commitment     string         `json:"commitment"`
+	Revealed       bool           `json:"revealed"`
+	Price          int            `json:"price"`
+}
+
+// sealedBid is the secret part of a bid, passed in the transient map
+type sealedBid struct {
+	Price int    `json:"price"`
+	Salt  string `json:"salt"`
+}
+
+// ============================================================================
+// openAuction - put a marble up for auction, starting the bidding phase.
+// The bidding and reveal periods are given in seconds.
+// ============================================================================
+func (t *SimpleChaincode) openAuction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	//      0         1          2         3
+	// "marble1", ["10", ["3600", "3600"]]
+	if len(args) != 1 && len(args) != 2 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 1, 2 or 4")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	reservePrice := 0
+	if len(args) > 1 {
+		reservePrice, err = strconv.Atoi(args[1])
+		if err != nil || reservePrice < 0 {
+			return shim.Error("2nd argument must be a non-negative numeric string")
+		}
+	}
+	biddingPeriod, revealPeriod := int64(defaultBiddingPeriod), int64(defaultRevealPeriod)
+	if len(args) > 2 {
+		biddingPeriod, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || biddingPeriod <= 0 {
+			return shim.Error("3rd argument must be a positive numeric string")
+		}
+		revealPeriod, err = strconv.ParseInt(args[3], 10, 64)
+		if err != nil || revealPeriod <= 0 {
+			return shim.Error("4th argument must be a positive numeric string")
+		}
+	}
+
+	marbleToSell, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleOwner(stub, marbleToSell)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotEscrowed(stub, marbleToSell.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, marbleToSell.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	auction := &marbleAuction{
+		ObjectType:     "marbleAuction",
+		ID:             stub.GetTxID(),
+		Marble:         marbleToSell.Name,
+		Seller:         marbleToSell.Owner,
+		SellerIdentity: marbleToSell.OwnerIdentity,
+		ReservePrice:   reservePrice,
+		Status:         auctionBidding,
+		BiddingEnds:    txTime.Unix() + biddingPeriod,
+		RevealEnds:     txTime.Unix() + biddingPeriod + revealPeriod,
+	}
+	auctionJSONasBytes, err := putAuction(stub, auction)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Lock the marble until the auction is closed ====
+	lockKey, err := stub.CreateCompositeKey("marbleAuctionLock", []string{marbleToSell.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(lockKey, []byte(auction.ID))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end openAuction " + auction.ID)
+	return shim.Success(auctionJSONasBytes)
+}
+
+// ============================================================================
+// submitBid - commit to a sealed bid while the auction is taking bids.
+// Bidding again replaces the previous commitment.
+// ============================================================================
+func (t *SimpleChaincode) submitBid(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0           1
+	// "auctionID", "jerry"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	auction, err := getAuctionInPhase(stub, args[0], auctionBidding)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bidder, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bidder == auction.SellerIdentity {
+		return shim.Error("The seller cannot bid on their own marble")
+	}
+	err = assertBeforeDeadline(stub, auction.BiddingEnds, "Bidding on auction "+auction.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	secret, err := getSealedBid(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bid := &marbleBid{
+		ObjectType:     "marbleBid",
+		AuctionID:      auction.ID,
+		Bidder:         strings.ToLower(args[1]),
+		BidderIdentity: bidder,
+		Commitment:     bidCommitment(auction.ID, bidder, secret),
+	}
+	bidJSONasBytes, err := putBid(stub, bid)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end submitBid " + auction.ID)
+	return shim.Success(bidJSONasBytes)
+}
+
+// ============================================================================
+// startReveal - stop taking bids and let bidders reveal them. The seller can do
+// this at any time, anyone else once the bidding deadline has passed.
+// ============================================================================
+func (t *SimpleChaincode) startReveal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "auctionID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	auction, err := getAuctionInPhase(stub, args[0], auctionBidding)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMayAdvance(stub, auction, auction.BiddingEnds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	auction.Status = auctionRevealing
+	auctionJSONasBytes, err := putAuction(stub, auction)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(auctionJSONasBytes)
+}
+
+// ============================================================================
+// revealBid - open the submitter's sealed bid during the reveal phase
+// ============================================================================
+func (t *SimpleChaincode) revealBid(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "auctionID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	auction, err := getAuctionInPhase(stub, args[0], auctionRevealing)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bidder, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertBeforeDeadline(stub, auction.RevealEnds, "Revealing bids of auction "+auction.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bid, err := getBid(stub, auction.ID, bidder)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bid.Revealed {
+		return shim.Error("Bid has already been revealed")
+	}
+
+	secret, err := getSealedBid(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bidCommitment(auction.ID, bidder, secret) != bid.Commitment {
+		return shim.Error("Revealed bid does not match the sealed bid")
+	}
+
+	bid.Revealed = true
+	bid.Price = secret.Price
+	bidJSONasBytes, err := putBid(stub, bid)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(bidJSONasBytes)
+}
+
+// ============================================================================
+// closeAuction - end the reveal phase and transfer the marble to the highest
+// revealed bid at or above the reserve price. Unrevealed bids are ignored.
+// The seller can do this at any time during the reveal phase, anyone else once
+// the reveal deadline has passed, even if the reveal phase was never started.
+// ============================================================================
+func (t *SimpleChaincode) closeAuction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "auctionID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// bids cannot have been revealed if the reveal phase never started, so such an
+	// auction closes without a winner
+	skippedReveal := auction.Status == auctionBidding && txTime.Unix() > auction.RevealEnds
+	if auction.Status != auctionRevealing && !skippedReveal {
+		return shim.Error(fmt.Sprintf("Auction %s is %s, not %s", auction.ID, auction.Status, auctionRevealing))
+	}
+	err = assertMayAdvance(stub, auction, auction.RevealEnds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Find the highest revealed bid. Ties go to the first bid in key order ====
+	bidsIterator, err := stub.GetStateByPartialCompositeKey("marbleBid", []string{auction.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer bidsIterator.Close()
+
+	var winningBid *marbleBid
+	for bidsIterator.HasNext() {
+		responseRange, err := bidsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		bid := &marbleBid{}
+		err = json.Unmarshal(responseRange.Value, bid)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !bid.Revealed || bid.Price < auction.ReservePrice {
+			continue
+		}
+		if winningBid == nil || bid.Price > winningBid.Price {
+			winningBid = bid
+		}
+	}
+
+	auction.Status = auctionClosed
+	marbleToSell, err := getMarble(stub, auction.Marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToSell.OwnerIdentity != auction.SellerIdentity {
+		auction.Outcome = "marble is no longer owned by the seller"
+	} else if winningBid == nil {
+		auction.Outcome = "no valid bids"
+	} else if err = assertOwnerQuota(stub, winningBid.BidderIdentity, 1); err != nil {
+		auction.Outcome = "winner cannot own more marbles: " + err.Error()
+	} else {
+		err = assertMarbleNotEscrowed(stub, marbleToSell.Name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, err = changeMarbleOwner(stub, marbleToSell, winningBid.Bidder, winningBid.BidderIdentity)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		auction.Winner = winningBid.Bidder
+		auction.WinnerIdentity = winningBid.BidderIdentity
+		auction.WinningPrice = winningBid.Price
+		auction.Outcome = "sold"
+	}
+
+	auctionJSONasBytes, err := putAuction(stub, auction)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Release the marble ====
+	lockKey, err := stub.CreateCompositeKey("marbleAuctionLock", []string{auction.Marble})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(lockKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end closeAuction " + auction.ID + ": " + auction.Outcome)
+	return shim.Success(auctionJSONasBytes)
+}
+
+// ============================================================================
+// readAuction - read an auction from chaincode state
+// ============================================================================
+func (t *SimpleChaincode) readAuction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "auctionID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	auction, err := getAuction(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	auctionJSONasBytes, err := json.Marshal(auction)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(auctionJSONasBytes)
+}
+
+// ============================================================================
+// queryAuctionBids - list the bids of an auction. Until a bid is revealed only
+// its commitment is known.
+// ============================================================================
+func (t *SimpleChaincode) queryAuctionBids(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "auctionID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("marbleBid", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(buffer.Bytes())
+}
+
+func getSealedBid(stub shim.ChaincodeStubInterface) (*sealedBid, error) {
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting transient:%s", err.Error())
+	}
+	bidJSON, ok := transMap["bid"]
+	if !ok {
+		return nil, fmt.Errorf("bid must be a key in the transient map")
+	}
+
+	secret := &sealedBid{}
+	err = json.Unmarshal(bidJSON, secret)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of bid:%s", err.Error())
+	}
+	if secret.Price <= 0 {
+		return nil, fmt.Errorf("bid price must be a positive number")
+	}
+	if len(secret.Salt) < minBidSaltLength {
+		return nil, fmt.Errorf("bid salt must be at least %d characters", minBidSaltLength)
+	}
+	return secret, nil
+}
+
+// bidCommitment binds a sealed bid to its auction and bidder, so a commitment cannot be
+// copied by another bidder or replayed in another auction
+func bidCommitment(auctionID string, bidder marbleIdentity, secret *sealedBid) string {
+	hash := sha256.Sum256([]byte(auctionID + "\x00" + bidder.MSPID + "\x00" + bidder.ID + "\x00" + strconv.Itoa(secret.Price) + "\x00" + secret.Salt))
+	return hex.EncodeToString(hash[:])
+}
+
+// auctions and bids live under composite keys so that they stay out of marble range queries
+func getAuction(stub shim.ChaincodeStubInterface, auctionID string) (*marbleAuction, error) {
+	key, err := stub.CreateCompositeKey("marbleAuction", []string{auctionID})
+	if err != nil {
+		return nil, err
+	}
+	auctionAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get auction:%s", err.Error())
+	} else if auctionAsBytes == nil {
+		return nil, fmt.Errorf("Auction does not exist: %s", auctionID)
+	}
+
+	auction := &marbleAuction{}
+	err = json.Unmarshal(auctionAsBytes, auction)
+	if err != nil {
+		return nil, err
+	}
+	return auction, nil
+}
+
+// assertMarbleNotAuctioned fails while a marble is up for auction, from openAuction until
+// closeAuction
+func assertMarbleNotAuctioned(stub shim.ChaincodeStubInterface, marbleName string) error {
+	key, err := stub.CreateCompositeKey("marbleAuctionLock", []string{marbleName})
+	if err != nil {
+		return err
+	}
+	auctionID, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get auction lock:%s", err.Error())
+	} else if auctionID != nil {
+		return fmt.Errorf("Marble %s is up for auction %s", marbleName, string(auctionID))
+	}
+	return nil
+}
+
+// assertBeforeDeadline fails once the transaction timestamp is past deadline
+func assertBeforeDeadline(stub shim.ChaincodeStubInterface, deadline int64, what string) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if txTime.Unix() > deadline {
+		return fmt.Errorf("%s closed at %s", what, time.Unix(deadline, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// assertMayAdvance lets the seller end a phase of the auction early, and anyone end it
+// once its deadline has passed
+func assertMayAdvance(stub shim.ChaincodeStubInterface, auction *marbleAuction, deadline int64) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if txTime.Unix() > deadline {
+		return nil
+	}
+	err = assertSubmitter(stub, auction.SellerIdentity)
+	if err != nil {
+		return fmt.Errorf("Only the seller can move the auction on before %s: %s", time.Unix(deadline, 0).UTC().Format(time.RFC3339), err.Error())
+	}
+	return nil
+}
+
+func getAuctionInPhase(stub shim.ChaincodeStubInterface, auctionID string, status string) (*marbleAuction, error) {
+	auction, err := getAuction(stub, auctionID)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != status {
+		return nil, fmt.Errorf("Auction %s is %s, not %s", auctionID, auction.Status, status)
+	}
+	return auction, nil
+}
+
+func putAuction(stub shim.ChaincodeStubInterface, auction *marbleAuction) ([]byte, error) {
+	key, err := stub.CreateCompositeKey("marbleAuction", []string{auction.ID})
+	if err != nil {
+		return nil, err
+	}
+	auctionJSONasBytes, err := json.Marshal(auction)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, auctionJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return auctionJSONasBytes, nil
+}
+
+func getBid(stub shim.ChaincodeStubInterface, auctionID string, bidder marbleIdentity) (*marbleBid, error) {
+	key, err := stub.CreateCompositeKey("marbleBid", []string{auctionID, bidder.MSPID, bidder.ID})
+	if err != nil {
+		return nil, err
+	}
+	bidAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get bid:%s", err.Error())
+	} else if bidAsBytes == nil {
+		return nil, fmt.Errorf("No bid from %s in auction %s", bidder.ID, auctionID)
+	}
+
+	bid := &marbleBid{}
+	err = json.Unmarshal(bidAsBytes, bid)
+	if err != nil {
+		return nil, err
+	}
+	return bid, nil
+}
+
+func putBid(stub shim.ChaincodeStubInterface, bid *marbleBid) ([]byte, error) {
+	key, err := stub.CreateCompositeKey("marbleBid", []string{bid.AuctionID, bid.BidderIdentity.MSPID, bid.BidderIdentity.ID})
+	if err != nil {
+		return nil, err
+	}
+	bidJSONasBytes, err := json.Marshal(bid)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, bidJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return bidJSONasBytes, nil
+}
@@ -0,0 +1,171 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Burning marbles ====================================================================
+// burnMarble takes a marble out of play for good. Unlike delete, which removes the marble
+// so that its name can be minted again, burning keeps the record under the marble's key as
+// a tombstone that says who burned it, when and why:
+//   - the marble leaves the color~name, owner~name and identity~name indexes and all collections
+//   - getMarble refuses burned marbles, so they cannot be changed, traded or deleted
+//   - initMarble and initMarbles refuse to mint the name again
+//   - range and rich queries leave burned marbles out unless asked to include them
+// readMarble and the history functions still return the tombstone.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleBurn is the tombstone of a burned marble
+type marbleBurn struct {
+	BurnedBy marbleIdentity `json:"burnedBy"`
+	BurnedAt string         `json:"burnedAt"`
+	TxID     string         `json:"txId"`
+	Reason   string         `json:"reason,omitempty"`
+}
+
+// ============================================================================
+// burnMarble - replace a marble with its tombstone
+// ============================================================================
+func (t *SimpleChaincode) burnMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0                1
+	// "marble1", ["chipped in a tournament"]
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	reason := ""
+	if len(args) == 2 {
+		reason = args[1]
+	}
+
+	marbleToBurn, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start burnMarble " + marbleToBurn.Name)
+
+	err = assertMarbleOwner(stub, marbleToBurn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotEscrowed(stub, marbleToBurn.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, marbleToBurn.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marbleToBurn.Burned = &marbleBurn{
+		BurnedBy: submitter,
+		BurnedAt: txTime.Format(time.RFC3339Nano),
+		TxID:     stub.GetTxID(),
+		Reason:   reason,
+	}
+	marbleToBurn.Version++
+	marbleJSONasBytes, err := putMarble(stub, marbleToBurn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== A burned marble is no longer found through the indexes ====
+	err = delIndexEntry(stub, "color~name", []string{marbleToBurn.Color, marbleToBurn.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delIndexEntry(stub, "owner~name", []string{marbleToBurn.Owner, marbleToBurn.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delIndexEntry(stub, "identity~name", identityIndexAttributes(marbleToBurn))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = removeFromAllCollections(stub, marbleToBurn.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = setMarbleEvent(stub, marbleBurnedEvent, marbleToBurn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end burnMarble (success)")
+	return shim.Success(marbleJSONasBytes)
+}
+
+// isBurned tells whether a marble record in state is a tombstone
+func isBurned(marbleAsBytes []byte) bool {
+	var tombstone struct {
+		Burned *marbleBurn `json:"burned"`
+	}
+	err := json.Unmarshal(marbleAsBytes, &tombstone)
+	return err == nil && tombstone.Burned != nil
+}
+
+// unburnedIterator passes on the results of a state query, leaving out burned marbles
+type unburnedIterator struct {
+	shim.StateQueryIteratorInterface
+	next *queryresult.KV
+	err  error
+}
+
+func (iter *unburnedIterator) HasNext() bool {
+	for iter.next == nil && iter.err == nil && iter.StateQueryIteratorInterface.HasNext() {
+		queryResponse, err := iter.StateQueryIteratorInterface.Next()
+		if err != nil {
+			iter.err = err
+		} else if !isBurned(queryResponse.Value) {
+			iter.next = queryResponse
+		}
+	}
+	return iter.next != nil || iter.err != nil
+}
+
+func (iter *unburnedIterator) Next() (*queryresult.KV, error) {
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("no more results")
+	}
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	queryResponse := iter.next
+	iter.next = nil
+	return queryResponse, nil
+}
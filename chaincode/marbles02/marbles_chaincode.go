@@ -19,24 +19,78 @@ under the License.
 
 // ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
 
+// ==== Instantiate with the private data collections of collections_config.json ====
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init"]}' -P "OR('Org1MSP.member','Org2MSP.member')" --collections-config $GOPATH/src/github.com/chaincode/marbles02/collections_config.json
+// To instantiate with game rules instead, pass a config to init:
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init","{\"maxMarblesPerOwner\":10,\"allowedColors\":[\"blue\",\"red\"],\"minSize\":1,\"maxSize\":100}"]}' -P "OR('Org1MSP.member','Org2MSP.member')" --collections-config $GOPATH/src/github.com/chaincode/marbles02/collections_config.json
+
 // ==== Invoke marbles ====
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble2","red","50","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
-// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
-// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarbles","[{\"name\":\"marble4\",\"color\":\"red\",\"size\":20,\"owner\":\"tom\"},{\"name\":\"marble5\",\"color\":\"green\",\"size\":25,\"owner\":\"jerry\"}]"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry","Org1MSP","<jerry's certificate ID>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry","Org1MSP","<jerry's certificate ID>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColorBatch","blue","jerry","Org1MSP","<jerry's certificate ID>","10","","tom","0","50"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["updateMarble","marble1","1","{\"color\":\"green\",\"size\":40}"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["updateConfig","{\"maxMarblesPerOwner\":20,\"allowedColors\":[\"blue\",\"red\",\"green\"]}"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["burnMarble","marble1","chipped in a tournament"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["proposeTrade","marble2","marble3","3600","10"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["acceptTrade","<proposeTrade txID>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["cancelTrade","<proposeTrade txID>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["openAuction","marble1","10","3600","3600"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["submitBid","<openAuction txID>","jerry"]}' --transient "{\"bid\":\"$(echo -n '{"price":50,"salt":"a long random string"}' | base64)\"}"
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["startReveal","<openAuction txID>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["revealBid","<openAuction txID>"]}' --transient "{\"bid\":\"$(echo -n '{"price":50,"salt":"a long random string"}' | base64)\"}"
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["closeAuction","<openAuction txID>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["createCollection","favourites"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["addToCollection","favourites","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["removeFromCollection","favourites","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["escrowMarble","marble1","jerry","Org1MSP","<jerry's certificate ID>","3600"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["releaseEscrow","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["cancelEscrow","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["setMarblePrivateDetails","marble1"]}' --transient "{\"marble_details\":\"$(echo -n '{"price":99,"appraisal":120,"salt":"a long random string"}' | base64)\"}"
 
 // ==== Query marbles ====
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarble","marble1"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3","true"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRangeWithPagination","marble1","marble3","3",""]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
-
-// Rich Query (Only supported if CouchDB is used as state database):
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1","true"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarbleAsOf","marble1","2018-06-01T10:00:00Z"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["ownershipTimeline","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readTrade","<proposeTrade txID>"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readAuction","<openAuction txID>"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryAuctionBids","<openAuction txID>"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryCollection","favourites"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryCollection","favourites","Org1MSP","<tom's certificate ID>"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarblePrivateDetails","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readEscrow","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readConfig"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["marbleStats"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["verifyProvenance","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["marbleStats","blue","","10","50"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["marbleStats","","","","","50",""]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["verifyMarblePrice","marble1"]}' --transient "{\"marble_price\":\"$(echo -n '{"price":99,"salt":"a long random string"}' | base64)\"}"
+
+// Parameterized query (rich query on CouchDB, owner~name index range query otherwise):
 //   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"}}"]}'
 
-//The following examples demonstrate creating indexes on CouchDB
+// Rich Query (Only supported if CouchDB is used as state database).
+// Queries must use one of the indexes in META-INF/statedb/couchdb/indexes, docType is always "marble":
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"},\"use_index\":\"_design/indexOwnerDoc\"}"]}'
+// Burned marbles are left out unless "true" is passed after the query string:
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"},\"use_index\":\"_design/indexOwnerDoc\"}","true"]}'
+
+// Rich Query with Pagination (Only supported if CouchDB is used as state database):
+// Pass the Bookmark from the ResponseMetadata of one page to fetch the next one
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesWithPagination","{\"selector\":{\"owner\":\"tom\"},\"use_index\":\"_design/indexOwnerDoc\"}","3",""]}'
+
+//The indexes below are shipped in META-INF/statedb/couchdb/indexes and created on the
+//channel when the chaincode is instantiated. queryMarbles only accepts queries that use them.
+//The following examples demonstrate creating indexes on CouchDB by hand
 //Example hostname:port configurations
 //
 //Docker or vagrant environments:
@@ -82,6 +136,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -96,6 +151,24 @@ type marble struct {
 	Color      string `json:"color"`
 	Size       int    `json:"size"`
 	Owner      string `json:"owner"`
+	// Creator is the submitter that created the marble. OwnerIdentity is the submitter
+	// allowed to transfer or delete it, see assertMarbleOwner
+	Creator       marbleIdentity `json:"creator"`
+	OwnerIdentity marbleIdentity `json:"ownerIdentity"`
+	// Version is incremented on every change to the marble, see updateMarble
+	Version int `json:"version"`
+	// ModifiedBy is the submitter of the last change, so that history can show who made it
+	ModifiedBy *marbleIdentity `json:"modifiedBy,omitempty"`
+	// Provenance is set when the marble is minted, see verifyProvenance
+	Provenance *marbleProvenance `json:"provenance,omitempty"`
+	// Burned is set when the marble is burned, the record is then a tombstone, see burnMarble
+	Burned *marbleBurn `json:"burned,omitempty"`
+}
+
+// marbleIdentity identifies a submitter by MSP ID and certificate ID
+type marbleIdentity struct {
+	MSPID string `json:"mspID"`
+	ID    string `json:"id"`
 }
 
 // ===================================================================================
@@ -111,6 +184,22 @@ func main() {
 // Init initializes chaincode
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+
+	//                        0
+	// ["{\"maxMarblesPerOwner\":10,\"allowedColors\":[\"blue\",\"red\"],\"minSize\":1,\"maxSize\":100}"]
+	config, err := configFromInitArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config == nil {
+		return shim.Success(nil)
+	}
+	configJSONasBytes, err := putConfig(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- init with config " + string(configJSONasBytes))
 	return shim.Success(nil)
 }
 
@@ -123,22 +212,90 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	// Handle different functions
 	if function == "initMarble" { //create a new marble
 		return t.initMarble(stub, args)
+	} else if function == "initMarbles" { //create many marbles from a JSON array of marble specs
+		return t.initMarbles(stub, args)
 	} else if function == "transferMarble" { //change owner of a specific marble
 		return t.transferMarble(stub, args)
+	} else if function == "updateMarble" { //change the color or size of a marble
+		return t.updateMarble(stub, args)
 	} else if function == "transferMarblesBasedOnColor" { //transfer all marbles of a certain color
 		return t.transferMarblesBasedOnColor(stub, args)
+	} else if function == "transferMarblesBasedOnColorBatch" { //transfer the next batch of marbles of a certain color
+		return t.transferMarblesBasedOnColorBatch(stub, args)
 	} else if function == "delete" { //delete a marble
 		return t.delete(stub, args)
+	} else if function == "burnMarble" { //replace a marble with a tombstone
+		return t.burnMarble(stub, args)
 	} else if function == "readMarble" { //read a marble
 		return t.readMarble(stub, args)
-	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query
+	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query or the owner~name index
 		return t.queryMarblesByOwner(stub, args)
 	} else if function == "queryMarbles" { //find marbles based on an ad hoc rich query
 		return t.queryMarbles(stub, args)
 	} else if function == "getHistoryForMarble" { //get history of values for a marble
 		return t.getHistoryForMarble(stub, args)
+	} else if function == "readMarbleAsOf" { //read a marble as it was at a point in time
+		return t.readMarbleAsOf(stub, args)
+	} else if function == "ownershipTimeline" { //list the owners of a marble over time
+		return t.ownershipTimeline(stub, args)
 	} else if function == "getMarblesByRange" { //get marbles based on range query
 		return t.getMarblesByRange(stub, args)
+	} else if function == "getMarblesByRangeWithPagination" { //get a page of marbles based on range query
+		return t.getMarblesByRangeWithPagination(stub, args)
+	} else if function == "queryMarblesWithPagination" { //find a page of marbles based on an ad hoc rich query
+		return t.queryMarblesWithPagination(stub, args)
+	} else if function == "proposeTrade" { //offer to swap one marble for another
+		return t.proposeTrade(stub, args)
+	} else if function == "acceptTrade" { //swap the marbles of a trade proposal
+		return t.acceptTrade(stub, args)
+	} else if function == "cancelTrade" { //withdraw or decline a trade proposal
+		return t.cancelTrade(stub, args)
+	} else if function == "readTrade" { //read a trade proposal
+		return t.readTrade(stub, args)
+	} else if function == "openAuction" { //put a marble up for a sealed-bid auction
+		return t.openAuction(stub, args)
+	} else if function == "submitBid" { //commit to a sealed bid
+		return t.submitBid(stub, args)
+	} else if function == "startReveal" { //stop taking bids and start the reveal phase
+		return t.startReveal(stub, args)
+	} else if function == "revealBid" { //open a sealed bid
+		return t.revealBid(stub, args)
+	} else if function == "closeAuction" { //sell the marble to the highest revealed bid
+		return t.closeAuction(stub, args)
+	} else if function == "readAuction" { //read an auction
+		return t.readAuction(stub, args)
+	} else if function == "queryAuctionBids" { //list the bids of an auction
+		return t.queryAuctionBids(stub, args)
+	} else if function == "createCollection" { //create a named collection of marbles
+		return t.createCollection(stub, args)
+	} else if function == "addToCollection" { //add a marble to a collection
+		return t.addToCollection(stub, args)
+	} else if function == "removeFromCollection" { //take a marble out of a collection
+		return t.removeFromCollection(stub, args)
+	} else if function == "queryCollection" { //list the marbles of a collection
+		return t.queryCollection(stub, args)
+	} else if function == "setMarblePrivateDetails" { //set the private price and appraisal of a marble
+		return t.setMarblePrivateDetails(stub, args)
+	} else if function == "readMarblePrivateDetails" { //read the private details of a marble
+		return t.readMarblePrivateDetails(stub, args)
+	} else if function == "verifyMarblePrice" { //check a price against the private price hash
+		return t.verifyMarblePrice(stub, args)
+	} else if function == "escrowMarble" { //lock a marble for a counterparty while payment clears
+		return t.escrowMarble(stub, args)
+	} else if function == "releaseEscrow" { //transfer an escrowed marble to the counterparty
+		return t.releaseEscrow(stub, args)
+	} else if function == "cancelEscrow" { //unlock an escrowed marble
+		return t.cancelEscrow(stub, args)
+	} else if function == "readEscrow" { //read the escrow of a marble
+		return t.readEscrow(stub, args)
+	} else if function == "verifyProvenance" { //check the provenance of a marble against its history
+		return t.verifyProvenance(stub, args)
+	} else if function == "updateConfig" { //replace the rules of the game
+		return t.updateConfig(stub, args)
+	} else if function == "readConfig" { //read the rules of the game
+		return t.readConfig(stub, args)
+	} else if function == "marbleStats" { //count marbles by owner and color
+		return t.marbleStats(stub, args)
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
@@ -179,30 +336,84 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("3rd argument must be a numeric string")
 	}
 
+	// ==== Check the marble against the rules of the game ====
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMarble(color, size)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== The submitter becomes the creator and owning identity of the marble ====
+	creator, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = newMarbleQuota(config).add(stub, creator, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ==== Check if marble already exists ====
-	marbleAsBytes, err := stub.GetState(marbleName)
+	err = assertMarbleNameFree(stub, marbleName)
 	if err != nil {
-		return shim.Error("Failed to get marble: " + err.Error())
-	} else if marbleAsBytes != nil {
-		fmt.Println("This marble already exists: " + marbleName)
-		return shim.Error("This marble already exists: " + marbleName)
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
 	}
 
 	// ==== Create marble object and marshal to JSON ====
 	objectType := "marble"
-	marble := &marble{objectType, marbleName, color, size, owner}
-	marbleJSONasBytes, err := json.Marshal(marble)
+	marble := &marble{
+		ObjectType:    objectType,
+		Name:          marbleName,
+		Color:         color,
+		Size:          size,
+		Owner:         owner,
+		Creator:       creator,
+		OwnerIdentity: creator,
+		Version:       1,
+		ModifiedBy:    &creator,
+	}
+	editions := newMarbleEditions()
+	marble.Provenance, err = mintProvenance(stub, color, editions)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	err = putNewMarble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = editions.put(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = setMarbleEvent(stub, marbleCreatedEvent, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Marble saved and indexed. Return success ====
+	fmt.Println("- end init marble")
+	return shim.Success(nil)
+}
+
+// putNewMarble saves a marble that does not exist yet, together with its index entries
+func putNewMarble(stub shim.ChaincodeStubInterface, marble *marble) error {
+	marbleJSONasBytes, err := json.Marshal(marble)
+	if err != nil {
+		return err
+	}
 	//Alternatively, build the marble json string manually if you don't want to use struct marshalling
 	//marbleJSONasString := `{"docType":"Marble",  "name": "` + marbleName + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "owner": "` + owner + `"}`
 	//marbleJSONasBytes := []byte(str)
 
 	// === Save marble to state ===
-	err = stub.PutState(marbleName, marbleJSONasBytes)
+	err = stub.PutState(marble.Name, marbleJSONasBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	//  ==== Index the marble to enable color-based range queries, e.g. return all blue marbles ====
@@ -210,19 +421,28 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	//  The key is a composite key, with the elements that you want to range query on listed first.
 	//  In our case, the composite key is based on indexName~color~name.
 	//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marble.Color, marble.Name})
+	err = putIndexEntry(stub, "color~name", []string{marble.Color, marble.Name})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(colorNameIndexKey, value)
 
-	// ==== Marble saved and indexed. Return success ====
-	fmt.Println("- end init marble")
-	return shim.Success(nil)
+	//  ==== Index the marble by owner as well, so owner lookups work without rich query support ====
+	err = putIndexEntry(stub, "owner~name", []string{marble.Owner, marble.Name})
+	if err != nil {
+		return err
+	}
+
+	//  ==== And by owning identity, which the marble quota is counted against ====
+	err = putIndexEntry(stub, "identity~name", identityIndexAttributes(marble))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// identityIndexAttributes returns the identity~name index attributes of a marble
+func identityIndexAttributes(marble *marble) []string {
+	return []string{marble.OwnerIdentity.MSPID, marble.OwnerIdentity.ID, marble.Name}
 }
 
 // ===============================================
@@ -275,23 +495,49 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + marbleName + "\"}"
 		return shim.Error(jsonResp)
 	}
+	if marbleJSON.Burned != nil {
+		return shim.Error("Marble " + marbleName + " was burned, its tombstone cannot be deleted")
+	}
+
+	err = assertMarbleOwner(stub, &marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotEscrowed(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	err = stub.DelState(marbleName) //remove the marble from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
 
-	// maintain the index
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marbleJSON.Color, marbleJSON.Name})
+	// maintain the indexes
+	err = delIndexEntry(stub, "color~name", []string{marbleJSON.Color, marbleJSON.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delIndexEntry(stub, "owner~name", []string{marbleJSON.Owner, marbleJSON.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delIndexEntry(stub, "identity~name", identityIndexAttributes(&marbleJSON))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = removeFromAllCollections(stub, marbleJSON.Name)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	//  Delete index entry to state.
-	err = stub.DelState(colorNameIndexKey)
+	err = setMarbleEvent(stub, marbleDeletedEvent, marbleJSON)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return shim.Error(err.Error())
 	}
 	return shim.Success(nil)
 }
@@ -301,38 +547,162 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 // ===========================================================
 func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0       1
-	// "name", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0       1          2             3
+	// "name", "bob", "Org1MSP", "bob's certificate ID"
+	if len(args) < 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
 	}
 
 	marbleName := args[0]
 	newOwner := strings.ToLower(args[1])
+	newOwnerIdentity, err := parseMarbleIdentity(args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	fmt.Println("- start transferMarble ", marbleName, newOwner)
 
-	marbleAsBytes, err := stub.GetState(marbleName)
+	marbleToTransfer, err := getMarble(stub, marbleName)
 	if err != nil {
-		return shim.Error("Failed to get marble:" + err.Error())
-	} else if marbleAsBytes == nil {
-		return shim.Error("Marble does not exist")
+		return shim.Error(err.Error())
 	}
 
-	marbleToTransfer := marble{}
-	err = json.Unmarshal(marbleAsBytes, &marbleToTransfer) //unmarshal it aka JSON.parse()
+	err = assertMarbleOwner(stub, marbleToTransfer)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	marbleToTransfer.Owner = newOwner //change the owner
+	err = assertMarbleNotEscrowed(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToTransfer.OwnerIdentity != newOwnerIdentity {
+		err = assertOwnerQuota(stub, newOwnerIdentity, 1)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 
-	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
-	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
+	transfer, err := changeMarbleOwner(stub, marbleToTransfer, newOwner, newOwnerIdentity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	transferJSONasBytes, err := json.Marshal(transfer)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	fmt.Println("- end transferMarble (success)")
-	return shim.Success(nil)
+	return shim.Success(transferJSONasBytes)
+}
+
+// ===========================================================================================
+// updateMarble applies a partial JSON patch to a marble, e.g. {"color":"green","size":40}.
+// Only color and size can be patched; owners change through transferMarble.
+// The client passes the version of the marble it read, and the update is rejected if the
+// marble has changed since, so that concurrent updates do not silently overwrite each other.
+// ===========================================================================================
+func (t *SimpleChaincode) updateMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1                2
+	// "name", "version", "{\"color\":\"green\"}"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	marbleName := args[0]
+	expectedVersion, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+	fmt.Println("- start updateMarble ", marbleName, args[2])
+
+	var patch map[string]json.RawMessage
+	err = json.Unmarshal([]byte(args[2]), &patch)
+	if err != nil {
+		return shim.Error("Failed to decode JSON of patch: " + err.Error())
+	}
+	if len(patch) == 0 {
+		return shim.Error("Patch must change at least one field")
+	}
+
+	marbleToUpdate, err := getMarble(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleOwner(stub, marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotEscrowed(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToUpdate.Version != expectedVersion {
+		return shim.Error(fmt.Sprintf("Marble %s is at version %d, not %d. Read it again and retry", marbleName, marbleToUpdate.Version, expectedVersion))
+	}
+
+	oldColor := marbleToUpdate.Color
+	for field, value := range patch {
+		switch field {
+		case "color":
+			var color string
+			err = json.Unmarshal(value, &color)
+			if err != nil || len(color) <= 0 {
+				return shim.Error("color must be a non-empty string")
+			}
+			marbleToUpdate.Color = strings.ToLower(color)
+		case "size":
+			var size int
+			err = json.Unmarshal(value, &size)
+			if err != nil {
+				return shim.Error("size must be a number")
+			}
+			marbleToUpdate.Size = size
+		default:
+			return shim.Error(fmt.Sprintf("Field %s cannot be updated", field))
+		}
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMarble(marbleToUpdate.Color, marbleToUpdate.Size)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleToUpdate.Version++
+
+	marbleJSONasBytes, err := putMarble(stub, marbleToUpdate) //rewrite the marble
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Keep the color~name index in sync with the new color ====
+	if marbleToUpdate.Color != oldColor {
+		err = delIndexEntry(stub, "color~name", []string{oldColor, marbleName})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = putIndexEntry(stub, "color~name", []string{marbleToUpdate.Color, marbleName})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = setMarbleEvent(stub, marbleUpdatedEvent, marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end updateMarble (success)")
+	return shim.Success(marbleJSONasBytes)
 }
 
 // ===========================================================================================
@@ -345,52 +715,98 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 // invalidated by the committing peers if the result set has changed between endorsement
 // time and commit time.
 // Therefore, range queries are a safe option for performing update transactions based on query results.
+// Burned marbles are left out unless includeBurned is true.
 // ===========================================================================================
 func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	//      0          1             2
+	// "marble1", "marble3", ["includeBurned"]
 	if len(args) < 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
 	startKey := args[0]
 	endKey := args[1]
+	includeBurned := false
+	if len(args) > 2 {
+		var err error
+		includeBurned, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return shim.Error("3rd argument must be true or false")
+		}
+	}
 
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	defer resultsIterator.Close()
+	if !includeBurned {
+		resultsIterator = &unburnedIterator{StateQueryIteratorInterface: resultsIterator}
+	}
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
+	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================================
+// getMarblesByRangeWithPagination performs a range query based on the start and end keys
+// provided, returning at most pageSize marbles starting from bookmark. Pass an empty
+// bookmark for the first page and the returned Bookmark for each following page.
+// Burned marbles are left out unless includeBurned is true, so pages may hold fewer
+// marbles than the page size.
+// ===========================================================================================
+func (t *SimpleChaincode) getMarblesByRangeWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0          1         2         3              4
+	// "marble1", "marble3", "pageSize", "bookmark", ["includeBurned"]
+	if len(args) < 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	startKey := args[0]
+	endKey := args[1]
+	pageSize, err := parsePageSize(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bookmark := args[3]
+	includeBurned := false
+	if len(args) > 4 {
+		includeBurned, err = strconv.ParseBool(args[4])
 		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+			return shim.Error("5th argument must be true or false")
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+	}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	if !includeBurned {
+		resultsIterator = &unburnedIterator{StateQueryIteratorInterface: resultsIterator}
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", buffer.String())
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(buffer.Bytes())
+	bufferWithPaginationInfo, err := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- getMarblesByRangeWithPagination queryResult:\n%s\n", bufferWithPaginationInfo.String())
+
+	return shim.Success(bufferWithPaginationInfo.Bytes())
 }
 
 // ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
@@ -403,14 +819,18 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 // ===========================================================================================
 func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0       1
-	// "color", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0       1          2             3
+	// "color", "bob", "Org1MSP", "bob's certificate ID"
+	if len(args) < 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
 	}
 
 	color := args[0]
 	newOwner := strings.ToLower(args[1])
+	newOwnerIdentity, err := parseMarbleIdentity(args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	fmt.Println("- start transferMarblesBasedOnColor ", color, newOwner)
 
 	// Query the color~name index by color
@@ -421,7 +841,16 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	}
 	defer coloredMarbleResultsIterator.Close()
 
+	// transferMarble checks the quota of the new owning identity one marble at a time, against
+	// the marbles it had before this transaction. The quota counts the whole transfer.
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quota := newMarbleQuota(config)
+
 	// Iterate through result set and for each marble found, transfer to newOwner
+	batch := marbleBatchTransfer{Color: color, Transfers: []marbleTransfer{}}
 	var i int
 	for i = 0; coloredMarbleResultsIterator.HasNext(); i++ {
 		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
@@ -441,11 +870,29 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 
 		// Now call the transfer function for the found marble.
 		// Re-use the same function that is used to transfer individual marbles
-		response := t.transferMarble(stub, []string{returnedMarbleName, newOwner})
+		response := t.transferMarble(stub, []string{returnedMarbleName, newOwner, args[2], args[3]})
 		// if the transfer failed break out of loop and return error
 		if response.Status != shim.OK {
 			return shim.Error("Transfer failed: " + response.Message)
 		}
+		var transfer marbleTransfer
+		err = json.Unmarshal(response.Payload, &transfer)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if transfer.OldOwnerIdentity != newOwnerIdentity {
+			err = quota.add(stub, newOwnerIdentity, 1)
+			if err != nil {
+				return shim.Error("Transfer failed: " + err.Error())
+			}
+		}
+		batch.Transfers = append(batch.Transfers, transfer)
+	}
+
+	// replaces the events of the individual transfers
+	err = setMarbleEvent(stub, marblesTransferredEvent, batch)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	responsePayload := fmt.Sprintf("Transferred %d %s marbles to %s", i, color, newOwner)
@@ -453,62 +900,298 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	return shim.Success([]byte(responsePayload))
 }
 
-// =======Rich queries =========================================================================
-// Two examples of rich queries are provided below (parameterized query and ad hoc query).
-// Rich queries pass a query string to the state database.
-// Rich queries are only supported by state database implementations
-//  that support rich query (e.g. CouchDB).
-// The query string is in the syntax of the underlying state database.
-// With rich queries there is no guarantee that the result set hasn't changed between
-//  endorsement time and commit time, aka 'phantom reads'.
-// Therefore, rich queries should not be used in update transactions, unless the
-// application handles the possibility of result set changes between endorsement and commit time.
-// Rich queries can be used for point-in-time queries against a peer.
-// ============================================================================================
+// colorBatchResult is the response of transferMarblesBasedOnColorBatch. Bookmark is
+// empty once every marble of the color has been read.
+type colorBatchResult struct {
+	Transferred []string            `json:"transferred"`
+	Failed      []colorBatchFailure `json:"failed"`
+	Bookmark    string              `json:"bookmark"`
+}
 
-// ===== Example: Parameterized rich query =================================================
-// queryMarblesByOwner queries for marbles based on a passed in owner.
-// This is an example of a parameterized query where the query logic is baked into the chaincode,
-// and accepting a single query parameter (owner).
-// Only available on state databases that support rich query (e.g. CouchDB)
-// =========================================================================================
-func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+type colorBatchFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
 
-	//   0
-	// "bob"
+// ===========================================================================================
+// transferMarblesBasedOnColorBatch is a resumable transferMarblesBasedOnColor for colors
+// with too many marbles to transfer in one transaction. Each call reads at most batchSize
+// marbles of the color, in name order starting after bookmark, and returns the bookmark to
+// pass to the next call. A failed transfer is reported in the response instead of failing
+// the whole batch.
+// Marbles can optionally be filtered by current owner and by size range; empty filter
+// arguments are ignored. Every marble read counts towards batchSize, whether it is
+// transferred or skipped, so each call does a bounded amount of work.
+// Marbles are found through the color~name index. Paginated queries are not allowed in
+// update transactions, so each call resumes by skipping the index entries up to the
+// bookmark, which only reads their keys.
+// ===========================================================================================
+func (t *SimpleChaincode) transferMarblesBasedOnColorBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	//   0       1          2             3                  4            5          6        7          8
+	// "color", "bob", "Org1MSP", "bob's certificate ID", "batchSize", "bookmark", ["owner", "minSize", "maxSize"]
+	if len(args) < 6 || len(args) > 9 {
+		return shim.Error("Incorrect number of arguments. Expecting 6 to 9")
+	}
+
+	color := args[0]
+	newOwner := strings.ToLower(args[1])
+	newOwnerIdentity, err := parseMarbleIdentity(args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	batchSize, err := strconv.Atoi(args[4])
+	if err != nil || batchSize <= 0 {
+		return shim.Error("5th argument must be a positive numeric string")
+	}
+	bookmark := args[5]
+
+	ownerFilter := ""
+	if len(args) > 6 {
+		ownerFilter = strings.ToLower(args[6])
+	}
+	minSize, maxSize := -1, -1
+	if len(args) > 7 && args[7] != "" {
+		minSize, err = strconv.Atoi(args[7])
+		if err != nil {
+			return shim.Error("8th argument must be a numeric string")
+		}
+	}
+	if len(args) > 8 && args[8] != "" {
+		maxSize, err = strconv.Atoi(args[8])
+		if err != nil {
+			return shim.Error("9th argument must be a numeric string")
+		}
+	}
+	fmt.Println("- start transferMarblesBasedOnColorBatch ", color, newOwner, bookmark)
+
+	coloredMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey("color~name", []string{color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer coloredMarbleResultsIterator.Close()
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quota := newMarbleQuota(config)
+
+	result := colorBatchResult{Transferred: []string{}, Failed: []colorBatchFailure{}}
+	batch := marbleBatchTransfer{Color: color, Transfers: []marbleTransfer{}}
+	read := 0
+	for read < batchSize && coloredMarbleResultsIterator.HasNext() {
+		responseRange, err := coloredMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marbleName := compositeKeyParts[1]
+		// the index is in name order, so the marbles read by earlier calls come first
+		if marbleName <= bookmark {
+			continue
+		}
+		read++
+		// resume after this marble on the next call, whatever happens to it
+		result.Bookmark = marbleName
+
+		marbleToTransfer, err := getMarble(stub, marbleName)
+		if err != nil {
+			result.Failed = append(result.Failed, colorBatchFailure{Name: marbleName, Error: err.Error()})
+			continue
+		}
+		if ownerFilter != "" && marbleToTransfer.Owner != ownerFilter {
+			continue
+		}
+		if (minSize >= 0 && marbleToTransfer.Size < minSize) || (maxSize >= 0 && marbleToTransfer.Size > maxSize) {
+			continue
+		}
+
+		// marbles transferred earlier in the batch count against the quota of the new owning identity
+		gained := 0
+		if marbleToTransfer.OwnerIdentity != newOwnerIdentity {
+			gained = 1
+		}
+		err = quota.add(stub, newOwnerIdentity, gained)
+		if err != nil {
+			result.Failed = append(result.Failed, colorBatchFailure{Name: marbleName, Error: err.Error()})
+			continue
+		}
+		response := t.transferMarble(stub, []string{marbleName, newOwner, args[2], args[3]})
+		if response.Status != shim.OK {
+			quota.remove(newOwnerIdentity, gained)
+			result.Failed = append(result.Failed, colorBatchFailure{Name: marbleName, Error: response.Message})
+			continue
+		}
+		var transfer marbleTransfer
+		err = json.Unmarshal(response.Payload, &transfer)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		batch.Transfers = append(batch.Transfers, transfer)
+		result.Transferred = append(result.Transferred, marbleName)
+	}
+
+	// replaces the events of the individual transfers
+	err = setMarbleEvent(stub, marblesTransferredEvent, batch)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !coloredMarbleResultsIterator.HasNext() {
+		result.Bookmark = ""
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end transferMarblesBasedOnColorBatch: %d read, %d transferred, %d failed\n", read, len(result.Transferred), len(result.Failed))
+	return shim.Success(resultJSONasBytes)
+}
+
+// =======Rich queries =========================================================================
+// Two examples of rich queries are provided below (parameterized query and ad hoc query).
+// Rich queries pass a query string to the state database.
+// Rich queries are only supported by state database implementations
+//  that support rich query (e.g. CouchDB).
+// The query string is in the syntax of the underlying state database.
+// With rich queries there is no guarantee that the result set hasn't changed between
+//  endorsement time and commit time, aka 'phantom reads'.
+// Therefore, rich queries should not be used in update transactions, unless the
+// application handles the possibility of result set changes between endorsement and commit time.
+// Rich queries can be used for point-in-time queries against a peer.
+// ============================================================================================
+
+// ===== Example: Parameterized rich query =================================================
+// queryMarblesByOwner queries for marbles based on a passed in owner.
+// This is an example of a parameterized query where the query logic is baked into the chaincode,
+// and accepting a single query parameter (owner).
+// The rich query is only available on state databases that support rich query (e.g. CouchDB).
+// LevelDB refuses rich queries, and there the query falls back to a range query on the
+// owner~name index. Any other failure of the rich query is returned.
+// =========================================================================================
+func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "bob"
 	if len(args) < 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
 	owner := strings.ToLower(args[0])
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
+	// the selector is marshalled rather than formatted, so the owner cannot change the query
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"docType": "marble",
+			"owner":   owner,
+			"burned":  map[string]interface{}{"$exists": false},
+		},
+	}
+	queryString, err := json.Marshal(query)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	queryResults, err := getQueryResultForQueryString(stub, string(queryString))
+	if err != nil && richQueryUnsupported(err) {
+		fmt.Println("- rich query unavailable, falling back to owner~name index")
+		queryResults, err = getQueryResultForIndex(stub, "owner~name", []string{owner})
+	}
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(queryResults)
 }
 
+// richQueryUnsupported reports whether err is LevelDB refusing a rich query, as opposed to
+// the state database failing to run it.
+func richQueryUnsupported(err error) bool {
+	return strings.Contains(err.Error(), "not supported for leveldb")
+}
+
 // ===== Example: Ad hoc rich query ========================================================
 // queryMarbles uses a query string to perform a query for marbles.
-// Query string matching state database syntax is passed in and executed as is.
+// Query string matching state database syntax is passed in, checked against the rich
+// query limits in marbles_query.go and executed.
 // Supports ad hoc queries that can be defined at runtime by the client.
 // If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
+// Burned marbles are left out unless includeBurned is true.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
 func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "queryString"
+	//       0                1
+	// "queryString", ["includeBurned"]
 	if len(args) < 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
+	includeBurned := false
+	if len(args) > 1 {
+		var err error
+		includeBurned, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return shim.Error("2nd argument must be true or false")
+		}
+	}
 
-	queryString := args[0]
+	query, err := parseMarbleQuery(args[0], false, includeBurned)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	queryResults, err := getQueryResultForMarbleQuery(stub, query)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// ===== Example: Pagination with Ad hoc Rich Query ========================================
+// queryMarblesWithPagination uses a query string, page size and a bookmark to perform a query
+// for marbles. Query string matching state database syntax is passed in, checked against
+// the rich query limits in marbles_query.go and executed.
+// The number of fetched records would be equal to or lesser than the specified page size.
+// Supports ad hoc queries that can be defined at runtime by the client.
+// If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
+// Burned marbles are left out unless includeBurned is true.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// Paginated queries are only valid for read only transactions.
+// =========================================================================================
+func (t *SimpleChaincode) queryMarblesWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0            1           2              3
+	// "queryString", "pageSize", "bookmark", ["includeBurned"]
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	includeBurned := false
+	if len(args) > 3 {
+		var err error
+		includeBurned, err = strconv.ParseBool(args[3])
+		if err != nil {
+			return shim.Error("4th argument must be true or false")
+		}
+	}
+
+	query, err := parseMarbleQuery(args[0], true, includeBurned)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pageSize > maxMarbleQueryResults {
+		return shim.Error(fmt.Sprintf("page size must be at most %d", maxMarbleQueryResults))
+	}
+	bookmark := args[2]
+
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, query.QueryString, pageSize, bookmark)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -529,99 +1212,472 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	}
 	defer resultsIterator.Close()
 
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// =========================================================================================
+// getQueryResultForQueryStringWithPagination executes the passed in query string with
+// pagination info. Result set is built and returned as a byte array containing the JSON results.
+// =========================================================================================
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryString:\n%s\n", queryString)
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	bufferWithPaginationInfo, err := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryResult:\n%s\n", bufferWithPaginationInfo.String())
+
+	return bufferWithPaginationInfo.Bytes(), nil
+}
+
+// =========================================================================================
+// getQueryResultForIndex performs a range query on a composite key index such as
+// owner~name and looks up the marble each index entry points to.
+// Result set is built and returned as a byte array containing the JSON results.
+// =========================================================================================
+func getQueryResultForIndex(stub shim.ChaincodeStubInterface, indexName string, attributes []string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForIndex index:%s attributes:%v\n", indexName, attributes)
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
 	// buffer is a JSON array containing QueryRecords
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 
 	bArrayMemberAlreadyWritten := false
 	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
+		responseRange, err := resultsIterator.Next()
 		if err != nil {
 			return nil, err
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+
+		// the marble name is always the last part of the index key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		marbleName := compositeKeyParts[len(compositeKeyParts)-1]
+
+		marbleAsBytes, err := stub.GetState(marbleName)
+		if err != nil {
+			return nil, err
+		} else if marbleAsBytes == nil {
+			continue
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
+		if err := writeQueryRecord(&buffer, marbleName, marbleAsBytes, bArrayMemberAlreadyWritten); err != nil {
+			return nil, err
+		}
 		bArrayMemberAlreadyWritten = true
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
-
 	return buffer.Bytes(), nil
 }
 
-func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// ===========================================================================================
+// constructQueryResponseFromIterator constructs a JSON array containing query results from
+// a given result iterator
+// ===========================================================================================
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	// buffer is a JSON array containing QueryResults
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
 
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQueryRecord(&buffer, queryResponse.Key, queryResponse.Value, bArrayMemberAlreadyWritten); err != nil {
+			return nil, err
+		}
+		bArrayMemberAlreadyWritten = true
 	}
+	buffer.WriteString("]")
 
-	marbleName := args[0]
+	return &buffer, nil
+}
 
-	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
+// ===========================================================================================
+// addPaginationMetadataToQueryResults wraps a JSON array of query results, as built by
+// constructQueryResponseFromIterator, together with the response metadata of the page:
+// {"Records":[...],"ResponseMetadata":{"RecordsCount":3,"Bookmark":"..."}}
+// RecordsCount is the number of records in the page. It can be lower than the number of
+// records the peer fetched, as burned marbles are left out after fetching.
+// ===========================================================================================
+func addPaginationMetadataToQueryResults(buffer *bytes.Buffer, responseMetadata *pb.QueryResponseMetadata) (*bytes.Buffer, error) {
+	var records []json.RawMessage
+	err := json.Unmarshal(buffer.Bytes(), &records)
+	if err != nil {
+		return nil, err
+	}
+	var bookmark string
+	if responseMetadata != nil {
+		bookmark = responseMetadata.Bookmark
+	}
+	// range query bookmarks are state keys, which may hold characters that need escaping
+	bookmarkJSON, err := json.Marshal(bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	var bufferWithPaginationInfo bytes.Buffer
+	bufferWithPaginationInfo.WriteString("{\"Records\":")
+	bufferWithPaginationInfo.Write(buffer.Bytes())
+	bufferWithPaginationInfo.WriteString(",\"ResponseMetadata\":{\"RecordsCount\":")
+	bufferWithPaginationInfo.WriteString(strconv.Itoa(len(records)))
+	bufferWithPaginationInfo.WriteString(",\"Bookmark\":")
+	bufferWithPaginationInfo.Write(bookmarkJSON)
+	bufferWithPaginationInfo.WriteString("}}")
 
-	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	return &bufferWithPaginationInfo, nil
+}
+
+// parsePageSize parses the page size argument of the paginated queries
+func parsePageSize(arg string) (int32, error) {
+	pageSize, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil || pageSize <= 0 {
+		return 0, fmt.Errorf("page size must be a positive numeric string")
+	}
+	return int32(pageSize), nil
+}
+
+// queryRecord is a single member of a JSON array of query results
+type queryRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// writeQueryRecord appends a single {"Key", "Record"} member to a JSON array of query results.
+// The member is marshalled, so keys are escaped and a record that is not JSON is an error.
+func writeQueryRecord(buffer *bytes.Buffer, key string, value []byte, bArrayMemberAlreadyWritten bool) error {
+	recordAsBytes, err := json.Marshal(queryRecord{Key: key, Record: value})
 	if err != nil {
-		return shim.Error(err.Error())
+		return fmt.Errorf("Failed to encode query result %s: %s", key, err.Error())
 	}
-	defer resultsIterator.Close()
+	// Add a comma before array members, suppress it for the first array member
+	if bArrayMemberAlreadyWritten == true {
+		buffer.WriteString(",")
+	}
+	buffer.Write(recordAsBytes)
+	return nil
+}
 
-	// buffer is a JSON array containing historic values for the marble
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+// ===========================================================================================
+// getMarble reads a marble from chaincode state
+// ===========================================================================================
+func getMarble(stub shim.ChaincodeStubInterface, marbleName string) (*marble, error) {
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get marble:%s", err.Error())
+	} else if marbleAsBytes == nil {
+		return nil, fmt.Errorf("Marble does not exist: %s", marbleName)
+	}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
+	marbleJSON := &marble{}
+	err = json.Unmarshal(marbleAsBytes, marbleJSON) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return nil, err
+	}
+	if marbleJSON.Burned != nil {
+		return nil, fmt.Errorf("Marble %s was burned", marbleName)
+	}
+	return marbleJSON, nil
+}
+
+// assertMarbleNameFree fails if a marble, or the tombstone of a burned marble, is stored
+// under marbleName
+func assertMarbleNameFree(stub shim.ChaincodeStubInterface, marbleName string) error {
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return fmt.Errorf("Failed to get marble: %s", err.Error())
+	} else if marbleAsBytes == nil {
+		return nil
+	} else if isBurned(marbleAsBytes) {
+		return fmt.Errorf("This marble was burned and cannot be minted again: %s", marbleName)
+	}
+	return fmt.Errorf("This marble already exists: %s", marbleName)
+}
+
+// ===========================================================================================
+// changeMarbleOwner rewrites a marble with a new owner and moves its owner~name and
+// identity~name index entries.
+// A marble that changes owning identity leaves all collections.
+// Sets the marbleTransferred event and returns the transfer it describes.
+// Callers are responsible for checking that the change of ownership is allowed.
+// ===========================================================================================
+func changeMarbleOwner(stub shim.ChaincodeStubInterface, marbleToTransfer *marble, newOwner string, newOwnerIdentity marbleIdentity) (*marbleTransfer, error) {
+	oldOwner := marbleToTransfer.Owner
+	oldOwnerIdentity := marbleToTransfer.OwnerIdentity
+	marbleToTransfer.Owner = newOwner //change the owner
+	marbleToTransfer.OwnerIdentity = newOwnerIdentity
+	marbleToTransfer.Version++
+
+	_, err := putMarble(stub, marbleToTransfer) //rewrite the marble
+	if err != nil {
+		return nil, err
+	}
+
+	// move the owner~name index entry to the new owner
+	err = delIndexEntry(stub, "owner~name", []string{oldOwner, marbleToTransfer.Name})
+	if err != nil {
+		return nil, err
+	}
+	err = putIndexEntry(stub, "owner~name", []string{newOwner, marbleToTransfer.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	// and the identity~name index entry to the new owning identity
+	if newOwnerIdentity != oldOwnerIdentity {
+		err = delIndexEntry(stub, "identity~name", []string{oldOwnerIdentity.MSPID, oldOwnerIdentity.ID, marbleToTransfer.Name})
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
+		}
+		err = putIndexEntry(stub, "identity~name", identityIndexAttributes(marbleToTransfer))
+		if err != nil {
+			return nil, err
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+	}
+
+	// collections only hold marbles of their owner
+	if newOwnerIdentity != oldOwnerIdentity {
+		err = removeFromAllCollections(stub, marbleToTransfer.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transfer := &marbleTransfer{
+		Name:             marbleToTransfer.Name,
+		OldOwner:         oldOwner,
+		OldOwnerIdentity: oldOwnerIdentity,
+		NewOwner:         newOwner,
+		NewOwnerIdentity: newOwnerIdentity,
+	}
+	err = setMarbleEvent(stub, marbleTransferredEvent, transfer)
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// ===========================================================================================
+// putMarble writes a changed marble to state, recording the submitter as its last modifier
+// ===========================================================================================
+func putMarble(stub shim.ChaincodeStubInterface, marbleToPut *marble) ([]byte, error) {
+	modifier, err := getSubmitter(stub)
+	if err != nil {
+		return nil, err
+	}
+	marbleToPut.ModifiedBy = &modifier
+
+	marbleJSONasBytes, err := json.Marshal(marbleToPut)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(marbleToPut.Name, marbleJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return marbleJSONasBytes, nil
+}
+
+// ===========================================================================================
+// Submitter identity
+// Marbles are owned by a submitter identity (MSP ID and certificate ID) as well as by an
+// owner name. Only that identity, or a submitter whose certificate carries the attribute
+// marbles.admin=true, may transfer or delete the marble.
+// ===========================================================================================
+
+// newClientIdentity reads the submitter's identity from the signed proposal. Tests replace
+// it, as MockStub has no creator certificate.
+var newClientIdentity = func(stub shim.ChaincodeStubInterface) (cid.ClientIdentity, error) {
+	return cid.New(stub)
+}
+
+func getSubmitter(stub shim.ChaincodeStubInterface) (marbleIdentity, error) {
+	clientIdentity, err := newClientIdentity(stub)
+	if err != nil {
+		return marbleIdentity{}, fmt.Errorf("Failed to get submitter identity:%s", err.Error())
+	}
+	mspID, err := clientIdentity.GetMSPID()
+	if err != nil {
+		return marbleIdentity{}, fmt.Errorf("Failed to get submitter MSP ID:%s", err.Error())
+	}
+	id, err := clientIdentity.GetID()
+	if err != nil {
+		return marbleIdentity{}, fmt.Errorf("Failed to get submitter ID:%s", err.Error())
+	}
+	return marbleIdentity{MSPID: mspID, ID: id}, nil
+}
+
+func parseMarbleIdentity(mspID string, id string) (marbleIdentity, error) {
+	if len(mspID) <= 0 || len(id) <= 0 {
+		return marbleIdentity{}, fmt.Errorf("Owner MSP ID and certificate ID must be non-empty strings")
+	}
+	return marbleIdentity{MSPID: mspID, ID: id}, nil
+}
+
+func isMarblesAdmin(stub shim.ChaincodeStubInterface) bool {
+	clientIdentity, err := newClientIdentity(stub)
+	if err != nil {
+		return false
+	}
+	return clientIdentity.AssertAttributeValue("marbles.admin", "true") == nil
+}
+
+// assertSubmitter fails unless the submitter is one of the given identities or an admin
+func assertSubmitter(stub shim.ChaincodeStubInterface, allowed ...marbleIdentity) error {
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		return err
+	}
+	for _, identity := range allowed {
+		if identity.ID != "" && submitter == identity {
+			return nil
 		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
+	}
+	if isMarblesAdmin(stub) {
+		return nil
+	}
+	return fmt.Errorf("Submitter %s of %s is not allowed to do this", submitter.ID, submitter.MSPID)
+}
+
+// assertMarbleOwner fails unless the submitter is the marble's current owner or an admin
+func assertMarbleOwner(stub shim.ChaincodeStubInterface, marbleJSON *marble) error {
+	if err := assertSubmitter(stub, marbleJSON.OwnerIdentity); err != nil {
+		return fmt.Errorf("Only the owner of marble %s can do this: %s", marbleJSON.Name, err.Error())
+	}
+	return nil
+}
+
+// ===========================================================================================
+// getTxTime returns the timestamp of the current transaction, which is the same on every
+// endorsing peer and therefore safe to base decisions such as expiry on
+// ===========================================================================================
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to get transaction timestamp:%s", err.Error())
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
 
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON marble)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
+// ===========================================================================================
+// putIndexEntry and delIndexEntry maintain composite key 'indexes' such as color~name
+// ===========================================================================================
+func putIndexEntry(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return err
+	}
+	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
+	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	value := []byte{0x00}
+	return stub.PutState(indexKey, value)
+}
+
+func delIndexEntry(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return err
+	}
+	//  Delete index entry to state.
+	err = stub.DelState(indexKey)
+	if err != nil {
+		return fmt.Errorf("Failed to delete state:%s", err.Error())
+	}
+	return nil
+}
+
+// ===========================================================================================
+// getHistoryForMarble returns every committed write to a marble, oldest first:
+// [{"TxId":"...","Value":{...},"Timestamp":"2018-06-01T10:00:00Z","IsDelete":false}]
+// Value is null for deletes. Pass "true" as the 2nd argument to include the Submitter of
+// each write, which is omitted for deletes and for marbles written before it was recorded.
+// ===========================================================================================
+func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0            1
+	// "marble1", ["includeSubmitter"]
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	includeSubmitter := false
+	if len(args) > 1 {
+		var err error
+		includeSubmitter, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return shim.Error("2nd argument must be true or false")
 		}
+	}
+
+	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
 
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
+	history, err := getMarbleHistory(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
+	entries := []marbleHistoryEntry{}
+	for _, record := range history {
+		entry := marbleHistoryEntry{
+			TxID:      record.TxID,
+			Value:     record.Value,
+			Timestamp: record.Timestamp.Format(time.RFC3339Nano),
+			IsDelete:  record.IsDelete,
+		}
+		if includeSubmitter && !record.IsDelete {
+			// only the submitter is decoded, the value is returned as it was written
+			var written struct {
+				ModifiedBy *marbleIdentity `json:"modifiedBy"`
+			}
+			err = json.Unmarshal(record.Value, &written)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("Failed to decode marble written by %s: %s", record.TxID, err.Error()))
+			}
+			entry.Submitter = written.ModifiedBy
+		}
+		entries = append(entries, entry)
+	}
 
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	historyJSONasBytes, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- getHistoryForMarble returning:\n%s\n", buffer.String())
+	fmt.Printf("- getHistoryForMarble returning:\n%s\n", historyJSONasBytes)
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(historyJSONasBytes)
 }
@@ -0,0 +1,1702 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var (
+	tom   = marbleIdentity{MSPID: "Org1MSP", ID: "tom's id"}
+	jerry = marbleIdentity{MSPID: "Org2MSP", ID: "jerry's id"}
+)
+
+// testIdentity stands in for the certificate of the submitter
+type testIdentity struct {
+	identity   marbleIdentity
+	attributes map[string]string
+}
+
+func (ti *testIdentity) GetID() (string, error) {
+	return ti.identity.ID, nil
+}
+
+func (ti *testIdentity) GetMSPID() (string, error) {
+	return ti.identity.MSPID, nil
+}
+
+func (ti *testIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := ti.attributes[attrName]
+	return value, found, nil
+}
+
+func (ti *testIdentity) AssertAttributeValue(attrName, attrValue string) error {
+	value, found := ti.attributes[attrName]
+	if !found || value != attrValue {
+		return fmt.Errorf("attribute %s is not %s", attrName, attrValue)
+	}
+	return nil
+}
+
+func (ti *testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// setSubmitter makes identity the submitter of the following transactions
+func setSubmitter(identity marbleIdentity, attributes map[string]string) {
+	newClientIdentity = func(stub shim.ChaincodeStubInterface) (cid.ClientIdentity, error) {
+		return &testIdentity{identity: identity, attributes: attributes}, nil
+	}
+}
+
+func newMarblesStub() *shim.MockStub {
+	setSubmitter(tom, nil)
+	return shim.NewMockStub("marbles", new(SimpleChaincode))
+}
+
+func invoke(stub *shim.MockStub, args ...string) (int32, string, []byte) {
+	var byteArgs [][]byte
+	for _, arg := range args {
+		byteArgs = append(byteArgs, []byte(arg))
+	}
+	res := stub.MockInvoke("1", byteArgs)
+	return res.Status, res.Message, res.Payload
+}
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args ...string) []byte {
+	status, message, payload := invoke(stub, args...)
+	if status != shim.OK {
+		fmt.Println("Invoke", args, "failed", message)
+		t.FailNow()
+	}
+	return payload
+}
+
+func checkInvokeFails(t *testing.T, stub *shim.MockStub, expectedMessage string, args ...string) {
+	status, message, _ := invoke(stub, args...)
+	if status == shim.OK {
+		fmt.Println("Invoke", args, "should have failed")
+		t.FailNow()
+	}
+	if !strings.Contains(message, expectedMessage) {
+		fmt.Println("Invoke", args, "failed with", message, "not", expectedMessage)
+		t.FailNow()
+	}
+}
+
+func checkMarble(t *testing.T, stub *shim.MockStub, name string, color string, size int, owner string, ownerIdentity marbleIdentity) {
+	bytes := stub.State[name]
+	if bytes == nil {
+		fmt.Println("Marble", name, "not found")
+		t.FailNow()
+	}
+	var m marble
+	err := json.Unmarshal(bytes, &m)
+	if err != nil {
+		fmt.Println("Marble", name, "is not valid JSON", string(bytes))
+		t.FailNow()
+	}
+	if m.ObjectType != "marble" || m.Name != name || m.Color != color || m.Size != size || m.Owner != owner || m.OwnerIdentity != ownerIdentity {
+		fmt.Println("Marble", name, "was", string(bytes), "not", color, size, owner, ownerIdentity)
+		t.FailNow()
+	}
+}
+
+func checkNoState(t *testing.T, stub *shim.MockStub, key string) {
+	if stub.State[key] != nil {
+		fmt.Println("State", key, "should not exist")
+		t.FailNow()
+	}
+}
+
+func checkIndexEntry(t *testing.T, stub *shim.MockStub, indexName string, attributes []string, exists bool) {
+	key, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		fmt.Println("Invalid index key", indexName, attributes)
+		t.FailNow()
+	}
+	if (stub.State[key] != nil) != exists {
+		fmt.Println("Index entry", indexName, attributes, "exists:", !exists, "expected:", exists)
+		t.FailNow()
+	}
+}
+
+// checkQueryKeys checks the keys of a JSON array of {"Key", "Record"} query results
+func checkQueryKeys(t *testing.T, payload []byte, expectedKeys ...string) {
+	var records []struct {
+		Key    string
+		Record marble
+	}
+	err := json.Unmarshal(payload, &records)
+	if err != nil {
+		fmt.Println("Query results are not valid JSON", string(payload))
+		t.FailNow()
+	}
+	keys := []string{}
+	for _, record := range records {
+		if record.Key != record.Record.Name {
+			fmt.Println("Query result", record.Key, "holds marble", record.Record.Name)
+			t.FailNow()
+		}
+		keys = append(keys, record.Key)
+	}
+	if expectedKeys == nil {
+		expectedKeys = []string{}
+	}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		fmt.Println("Query returned", keys, "not", expectedKeys)
+		t.FailNow()
+	}
+}
+
+// richQueryStub answers GetQueryResult, which MockStub does not implement, by matching
+// the selector against every JSON value in state. Only plain values, $eq and $exists are
+// supported.
+type richQueryStub struct {
+	*shim.MockStub
+	queries []string
+}
+
+func (stub *richQueryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	stub.queries = append(stub.queries, query)
+
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for key := range stub.State {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	iter := &stateIterator{}
+	for _, key := range keys {
+		var value map[string]interface{}
+		if json.Unmarshal(stub.State[key], &value) != nil {
+			continue
+		}
+		matches := true
+		for field, condition := range parsed.Selector {
+			operators, ok := condition.(map[string]interface{})
+			if !ok {
+				operators = map[string]interface{}{"$eq": condition}
+			}
+			for operator, operand := range operators {
+				switch operator {
+				case "$eq":
+					if !reflect.DeepEqual(value[field], operand) {
+						matches = false
+					}
+				case "$exists":
+					if _, exists := value[field]; exists != operand {
+						matches = false
+					}
+				default:
+					return nil, fmt.Errorf("richQueryStub does not support %s", operator)
+				}
+			}
+		}
+		if matches {
+			iter.kvs = append(iter.kvs, &queryresult.KV{Key: key, Value: stub.State[key]})
+		}
+	}
+	return iter, nil
+}
+
+type stateIterator struct {
+	kvs  []*queryresult.KV
+	next int
+}
+
+func (iter *stateIterator) HasNext() bool {
+	return iter.next < len(iter.kvs)
+}
+
+func (iter *stateIterator) Next() (*queryresult.KV, error) {
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("no more results")
+	}
+	iter.next++
+	return iter.kvs[iter.next-1], nil
+}
+
+func (iter *stateIterator) Close() error {
+	return nil
+}
+
+// queryErrorStub fails every rich query with err
+type queryErrorStub struct {
+	*shim.MockStub
+	err error
+}
+
+func (stub *queryErrorStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, stub.err
+}
+
+// invokeColorBatch runs transferMarblesBasedOnColorBatch in a transaction of its own
+func invokeColorBatch(t *testing.T, stub *shim.MockStub, args ...string) colorBatchResult {
+	stub.MockTransactionStart("1")
+	res := new(SimpleChaincode).transferMarblesBasedOnColorBatch(stub, args)
+	stub.MockTransactionEnd("1")
+	if res.Status != shim.OK {
+		fmt.Println("transferMarblesBasedOnColorBatch", args, "failed", res.Message)
+		t.FailNow()
+	}
+	var result colorBatchResult
+	err := json.Unmarshal(res.Payload, &result)
+	if err != nil {
+		fmt.Println("transferMarblesBasedOnColorBatch returned", string(res.Payload))
+		t.FailNow()
+	}
+	return result
+}
+
+func checkColorBatch(t *testing.T, result colorBatchResult, bookmark string, transferred ...string) {
+	if result.Bookmark != bookmark || len(result.Failed) != 0 || !reflect.DeepEqual(result.Transferred, append([]string{}, transferred...)) {
+		fmt.Println("Batch was", result, "not", transferred, "up to", bookmark)
+		t.FailNow()
+	}
+}
+
+// historyStub serves GetHistoryForKey from a fixed list of writes, which MockStub
+// does not implement
+type historyStub struct {
+	*shim.MockStub
+	history map[string][]*queryresult.KeyModification
+}
+
+func (stub *historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: stub.history[key]}, nil
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+	next          int
+}
+
+func (iter *historyIterator) HasNext() bool {
+	return iter.next < len(iter.modifications)
+}
+
+func (iter *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("no more history")
+	}
+	iter.next++
+	return iter.modifications[iter.next-1], nil
+}
+
+func (iter *historyIterator) Close() error {
+	return nil
+}
+
+func newHistoryStub() *historyStub {
+	tom := `{"mspID":"Org1MSP","id":"tom's id"}`
+	jerry := `{"mspID":"Org2MSP","id":"jerry's \"id\""}`
+	return &historyStub{
+		MockStub: shim.NewMockStub("marbles", new(SimpleChaincode)),
+		history: map[string][]*queryresult.KeyModification{
+			"marble1": {
+				{
+					TxId:      "tx1",
+					Value:     []byte(`{"docType":"marble","name":"marble1","color":"blue","size":35,"owner":"tom","creator":` + tom + `,"ownerIdentity":` + tom + `,"version":1,"modifiedBy":` + tom + `}`),
+					Timestamp: &timestamp.Timestamp{Seconds: 1527847200},
+				},
+				{
+					TxId:      "tx2",
+					Value:     []byte(`{"docType":"marble","name":"marble1","color":"blue","size":35,"owner":"jerry","creator":` + tom + `,"ownerIdentity":` + jerry + `,"version":2,"modifiedBy":` + jerry + `}`),
+					Timestamp: &timestamp.Timestamp{Seconds: 1527847260, Nanos: 500000000},
+				},
+				{
+					TxId:      "tx3",
+					Timestamp: &timestamp.Timestamp{Seconds: 1527847320},
+					IsDelete:  true,
+				},
+			},
+		},
+	}
+}
+
+func checkHistory(t *testing.T, stub *historyStub, args []string, expected string) {
+	res := new(SimpleChaincode).getHistoryForMarble(stub, args)
+	if res.Status != shim.OK {
+		fmt.Println("getHistoryForMarble", args, "failed", res.Message)
+		t.FailNow()
+	}
+
+	// compare decoded values, so that the check does not depend on key order
+	var actualValue, expectedValue interface{}
+	err := json.Unmarshal(res.Payload, &actualValue)
+	if err != nil {
+		fmt.Println("getHistoryForMarble returned invalid JSON", string(res.Payload))
+		t.FailNow()
+	}
+	err = json.Unmarshal([]byte(expected), &expectedValue)
+	if err != nil {
+		fmt.Println("Invalid expected history", err)
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(actualValue, expectedValue) {
+		fmt.Println("getHistoryForMarble returned", string(res.Payload), "not", expected)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_History(t *testing.T) {
+	stub := newHistoryStub()
+
+	checkHistory(t, stub, []string{"marble1"}, `[
+		{"TxId":"tx1","Timestamp":"2018-06-01T10:00:00Z","IsDelete":false,
+		 "Value":{"docType":"marble","name":"marble1","color":"blue","size":35,"owner":"tom",
+		          "creator":{"mspID":"Org1MSP","id":"tom's id"},"ownerIdentity":{"mspID":"Org1MSP","id":"tom's id"},
+		          "version":1,"modifiedBy":{"mspID":"Org1MSP","id":"tom's id"}}},
+		{"TxId":"tx2","Timestamp":"2018-06-01T10:01:00.5Z","IsDelete":false,
+		 "Value":{"docType":"marble","name":"marble1","color":"blue","size":35,"owner":"jerry",
+		          "creator":{"mspID":"Org1MSP","id":"tom's id"},"ownerIdentity":{"mspID":"Org2MSP","id":"jerry's \"id\""},
+		          "version":2,"modifiedBy":{"mspID":"Org2MSP","id":"jerry's \"id\""}}},
+		{"TxId":"tx3","Timestamp":"2018-06-01T10:02:00Z","IsDelete":true,"Value":null}
+	]`)
+}
+
+func TestMarbles_HistoryWithSubmitter(t *testing.T) {
+	stub := newHistoryStub()
+
+	res := new(SimpleChaincode).getHistoryForMarble(stub, []string{"marble1", "true"})
+	if res.Status != shim.OK {
+		fmt.Println("getHistoryForMarble failed", res.Message)
+		t.FailNow()
+	}
+
+	var entries []map[string]interface{}
+	err := json.Unmarshal(res.Payload, &entries)
+	if err != nil || len(entries) != 3 {
+		fmt.Println("getHistoryForMarble returned", string(res.Payload))
+		t.FailNow()
+	}
+	expectedSubmitters := []interface{}{
+		map[string]interface{}{"mspID": "Org1MSP", "id": "tom's id"},
+		map[string]interface{}{"mspID": "Org2MSP", "id": "jerry's \"id\""},
+		nil,
+	}
+	for i, entry := range entries {
+		if _, ok := entry["IsDelete"].(bool); !ok {
+			fmt.Println("IsDelete of entry", i, "is not a boolean")
+			t.FailNow()
+		}
+		submitter, ok := entry["Submitter"]
+		if expectedSubmitters[i] == nil {
+			if ok {
+				fmt.Println("Entry", i, "should not have a Submitter")
+				t.FailNow()
+			}
+			continue
+		}
+		if !reflect.DeepEqual(submitter, expectedSubmitters[i]) {
+			fmt.Println("Submitter of entry", i, "was", submitter, "not", expectedSubmitters[i])
+			t.FailNow()
+		}
+	}
+}
+
+func TestMarbles_HistoryOfOldWrites(t *testing.T) {
+	stub := newHistoryStub()
+	// written before creator and version existed, and with a field the chaincode no longer has
+	oldWrite := `{"docType":"marble","name":"marble0","color":"red","size":5,"owner":"tom","shine":"matte"}`
+	stub.history["marble0"] = []*queryresult.KeyModification{
+		{TxId: "tx0", Value: []byte(oldWrite), Timestamp: &timestamp.Timestamp{Seconds: 1527847200}},
+	}
+
+	// the write is returned as it was stored, nothing is added or dropped
+	checkHistory(t, stub, []string{"marble0", "true"}, `[
+		{"TxId":"tx0","Timestamp":"2018-06-01T10:00:00Z","IsDelete":false,"Value":`+oldWrite+`}
+	]`)
+	res := new(SimpleChaincode).readMarbleAsOf(stub, []string{"marble0", "tx0"})
+	if res.Status != shim.OK || string(res.Payload) != oldWrite {
+		fmt.Println("readMarbleAsOf returned", res.Message, string(res.Payload), "not", oldWrite)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_HistoryOfBurnedMarble(t *testing.T) {
+	stub := newHistoryStub()
+	tombstone := `{"docType":"marble","name":"marble1","color":"blue","size":35,"owner":"jerry","ownerIdentity":{"mspID":"Org2MSP","id":"jerry's id"},"version":3,` +
+		`"burned":{"burnedBy":{"mspID":"Org2MSP","id":"jerry's id"},"burnedAt":"2018-06-01T10:02:00Z","txId":"tx3"}}`
+	stub.history["marble1"][2] = &queryresult.KeyModification{TxId: "tx3", Value: []byte(tombstone), Timestamp: &timestamp.Timestamp{Seconds: 1527847320}}
+
+	// the tombstone is not the marble
+	for _, asOf := range []string{"tx3", "2018-06-01T10:02:00Z", "2019-01-01T00:00:00Z"} {
+		res := new(SimpleChaincode).readMarbleAsOf(stub, []string{"marble1", asOf})
+		if res.Status == shim.OK || !strings.Contains(res.Message, "Marble marble1 was burned as of "+asOf+", by transaction tx3") {
+			fmt.Println("readMarbleAsOf", asOf, "should have reported the burn, not", res.Message, string(res.Payload))
+			t.FailNow()
+		}
+	}
+	res := new(SimpleChaincode).readMarbleAsOf(stub, []string{"marble1", "2018-06-01T10:01:59Z"})
+	if res.Status != shim.OK || !strings.Contains(string(res.Payload), `"owner":"jerry"`) {
+		fmt.Println("readMarbleAsOf returned", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+
+	// and the timeline ends at the burn
+	res = new(SimpleChaincode).ownershipTimeline(stub, []string{"marble1"})
+	var timeline []ownershipInterval
+	json.Unmarshal(res.Payload, &timeline)
+	expected := []ownershipInterval{
+		{Owner: "tom", OwnerIdentity: tom, From: "2018-06-01T10:00:00Z", To: "2018-06-01T10:01:00.5Z", TxID: "tx1"},
+		{Owner: "jerry", OwnerIdentity: marbleIdentity{MSPID: "Org2MSP", ID: `jerry's "id"`}, From: "2018-06-01T10:01:00.5Z", To: "2018-06-01T10:02:00Z", TxID: "tx2", Burned: true},
+	}
+	if !reflect.DeepEqual(timeline, expected) {
+		fmt.Println("ownershipTimeline returned", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestMarbles_HistoryOfUnknownMarble(t *testing.T) {
+	stub := newHistoryStub()
+
+	checkHistory(t, stub, []string{"marble2"}, `[]`)
+}
+
+func TestMarbles_InitMarble(t *testing.T) {
+	stub := newMarblesStub()
+
+	checkInvoke(t, stub, "initMarble", "marble1", "Blue", "35", "Tom")
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+	checkIndexEntry(t, stub, "color~name", []string{"blue", "marble1"}, true)
+	checkIndexEntry(t, stub, "owner~name", []string{"tom", "marble1"}, true)
+	checkIndexEntry(t, stub, "identity~name", []string{tom.MSPID, tom.ID, "marble1"}, true)
+
+	checkInvokeFails(t, stub, "This marble already exists: marble1", "initMarble", "marble1", "red", "50", "tom")
+	checkInvokeFails(t, stub, "3rd argument must be a numeric string", "initMarble", "marble2", "red", "big", "tom")
+	checkInvokeFails(t, stub, "1st argument must be a non-empty string", "initMarble", "", "red", "50", "tom")
+	checkInvokeFails(t, stub, "Incorrect number of arguments. Expecting 4", "initMarble", "marble2", "red", "50")
+	checkNoState(t, stub, "marble2")
+}
+
+func TestMarbles_ReadMarble(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	payload := checkInvoke(t, stub, "readMarble", "marble1")
+	if string(payload) != string(stub.State["marble1"]) {
+		fmt.Println("readMarble returned", string(payload))
+		t.FailNow()
+	}
+
+	checkInvokeFails(t, stub, "Marble does not exist: marble2", "readMarble", "marble2")
+}
+
+func TestMarbles_TransferMarble(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	// only the owner can transfer
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "transferMarble", "marble1", "Jerry", jerry.MSPID, jerry.ID)
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+	checkIndexEntry(t, stub, "owner~name", []string{"tom", "marble1"}, false)
+	checkIndexEntry(t, stub, "owner~name", []string{"jerry", "marble1"}, true)
+
+	// tom no longer owns it
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "transferMarble", "marble1", "tom", tom.MSPID, tom.ID)
+
+	// admins can transfer any marble
+	setSubmitter(tom, map[string]string{"marbles.admin": "true"})
+	checkInvoke(t, stub, "transferMarble", "marble1", "tom", tom.MSPID, tom.ID)
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+
+	checkInvokeFails(t, stub, "Marble does not exist: marble2", "transferMarble", "marble2", "jerry", jerry.MSPID, jerry.ID)
+	checkInvokeFails(t, stub, "Owner MSP ID and certificate ID must be non-empty strings", "transferMarble", "marble1", "jerry", "", jerry.ID)
+	checkInvokeFails(t, stub, "Incorrect number of arguments. Expecting 4", "transferMarble", "marble1", "jerry")
+}
+
+func TestMarbles_Delete(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "delete", "marble1")
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "delete", "marble1")
+	checkNoState(t, stub, "marble1")
+	checkIndexEntry(t, stub, "color~name", []string{"blue", "marble1"}, false)
+	checkIndexEntry(t, stub, "owner~name", []string{"tom", "marble1"}, false)
+	checkIndexEntry(t, stub, "identity~name", []string{tom.MSPID, tom.ID, "marble1"}, false)
+
+	checkInvokeFails(t, stub, "Marble does not exist: marble1", "delete", "marble1")
+
+	// the name can be used again
+	checkInvoke(t, stub, "initMarble", "marble1", "red", "50", "tom")
+	checkMarble(t, stub, "marble1", "red", 50, "tom", tom)
+}
+
+func TestMarbles_GetMarblesByRange(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "tom")
+	checkInvoke(t, stub, "initMarble", "marble3", "blue", "70", "tom")
+
+	// the end key is exclusive, and index entries are not part of the range
+	checkQueryKeys(t, checkInvoke(t, stub, "getMarblesByRange", "marble1", "marble3"), "marble1", "marble2")
+	checkQueryKeys(t, checkInvoke(t, stub, "getMarblesByRange", "marble1", "marble4"), "marble1", "marble2", "marble3")
+	checkQueryKeys(t, checkInvoke(t, stub, "getMarblesByRange", "marble4", "marble9"))
+
+	checkInvokeFails(t, stub, "Incorrect number of arguments. Expecting 2", "getMarblesByRange", "marble1")
+}
+
+func TestMarbles_TransferMarblesBasedOnColor(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "tom")
+	checkInvoke(t, stub, "initMarble", "marble3", "blue", "70", "tom")
+
+	payload := checkInvoke(t, stub, "transferMarblesBasedOnColor", "blue", "jerry", jerry.MSPID, jerry.ID)
+	if string(payload) != "Transferred 2 blue marbles to jerry" {
+		fmt.Println("transferMarblesBasedOnColor returned", string(payload))
+		t.FailNow()
+	}
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+	checkMarble(t, stub, "marble2", "red", 50, "tom", tom)
+	checkMarble(t, stub, "marble3", "blue", 70, "jerry", jerry)
+	checkIndexEntry(t, stub, "owner~name", []string{"jerry", "marble1"}, true)
+	checkIndexEntry(t, stub, "owner~name", []string{"jerry", "marble3"}, true)
+	checkIndexEntry(t, stub, "owner~name", []string{"tom", "marble1"}, false)
+
+	// one marble that cannot be transferred fails the whole transaction
+	checkInvoke(t, stub, "initMarble", "marble4", "blue", "10", "tom")
+	checkInvokeFails(t, stub, "Transfer failed", "transferMarblesBasedOnColor", "blue", "tom", tom.MSPID, tom.ID)
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+	checkMarble(t, stub, "marble4", "blue", 10, "tom", tom)
+
+	payload = checkInvoke(t, stub, "transferMarblesBasedOnColor", "green", "jerry", jerry.MSPID, jerry.ID)
+	if string(payload) != "Transferred 0 green marbles to jerry" {
+		fmt.Println("transferMarblesBasedOnColor returned", string(payload))
+		t.FailNow()
+	}
+}
+
+func TestMarbles_TransferMarblesBasedOnColorBatch(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "10", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "10", "tom")
+	checkInvoke(t, stub, "initMarble", "marble3", "blue", "10", "jerry")
+	checkInvoke(t, stub, "initMarble", "marble4", "blue", "60", "tom")
+	checkInvoke(t, stub, "initMarble", "marble5", "blue", "20", "tom")
+	checkInvoke(t, stub, "initMarble", "marble6", "blue", "30", "tom")
+
+	// every marble of the color read counts towards the batch, whether or not the filters skip it
+	args := []string{"blue", "bob", jerry.MSPID, jerry.ID, "2", "", "tom", "", "50"}
+	result := invokeColorBatch(t, stub, args...)
+	checkColorBatch(t, result, "marble3", "marble1")
+	args[5] = result.Bookmark
+	result = invokeColorBatch(t, stub, args...)
+	checkColorBatch(t, result, "marble5", "marble5")
+	args[5] = result.Bookmark
+	result = invokeColorBatch(t, stub, args...)
+	checkColorBatch(t, result, "", "marble6")
+
+	checkMarble(t, stub, "marble1", "blue", 10, "bob", jerry)
+	checkMarble(t, stub, "marble2", "red", 10, "tom", tom)
+	checkMarble(t, stub, "marble3", "blue", 10, "jerry", tom)
+	checkMarble(t, stub, "marble4", "blue", 60, "tom", tom)
+	checkMarble(t, stub, "marble6", "blue", 30, "bob", jerry)
+
+	// a batch that reads the last marble is the last batch
+	result = invokeColorBatch(t, stub, "red", "bob", jerry.MSPID, jerry.ID, "6", "")
+	checkColorBatch(t, result, "", "marble2")
+	result = invokeColorBatch(t, stub, "red", "bob", jerry.MSPID, jerry.ID, "1", "marble6")
+	checkColorBatch(t, result, "")
+
+	// transfers that fail are reported and do not stop the batch
+	checkInvoke(t, stub, "initMarble", "marble7", "green", "10", "tom")
+	checkInvoke(t, stub, "initMarble", "marble8", "green", "10", "tom")
+	checkInvoke(t, stub, "burnMarble", "marble8")
+	checkInvoke(t, stub, "initMarble", "marble9", "green", "10", "tom")
+	checkInvoke(t, stub, "transferMarble", "marble7", "jerry", jerry.MSPID, jerry.ID)
+	result = invokeColorBatch(t, stub, "green", "tom", tom.MSPID, tom.ID, "5", "marble6")
+	if result.Bookmark != "" || !reflect.DeepEqual(result.Transferred, []string{"marble9"}) || len(result.Failed) != 1 || result.Failed[0].Name != "marble7" {
+		fmt.Println("Batch was", result)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_QueryMarblesByOwner(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "jerry")
+	checkInvoke(t, stub, "initMarble", "marble3", "blue", "70", "tom")
+
+	checkInvoke(t, stub, "initMarble", `marble"4`, "blue", "10", "tom")
+
+	// LevelDB has no rich query support, so this uses the owner~name index
+	levelDBStub := &queryErrorStub{MockStub: stub, err: errors.New("ExecuteQuery not supported for leveldb")}
+	for owner, expectedKeys := range map[string][]string{"Tom": {`marble"4`, "marble1", "marble3"}, "bob": nil} {
+		res := new(SimpleChaincode).queryMarblesByOwner(levelDBStub, []string{owner})
+		if res.Status != shim.OK {
+			fmt.Println("queryMarblesByOwner failed", res.Message)
+			t.FailNow()
+		}
+		checkQueryKeys(t, res.Payload, expectedKeys...)
+	}
+
+	// but any other failure of the rich query is reported
+	checkInvokeFails(t, stub, "not implemented", "queryMarblesByOwner", "tom")
+	res := new(SimpleChaincode).queryMarblesByOwner(&queryErrorStub{MockStub: stub, err: errors.New("couchdb is unreachable")}, []string{"tom"})
+	if res.Status == shim.OK || res.Message != "couchdb is unreachable" {
+		fmt.Println("queryMarblesByOwner should have failed, not", res.Message)
+		t.FailNow()
+	}
+
+	// the owner is a value of the selector, and cannot add to it
+	richStub := &richQueryStub{MockStub: stub}
+	res = new(SimpleChaincode).queryMarblesByOwner(richStub, []string{`tom","color":"red`})
+	if res.Status != shim.OK {
+		fmt.Println("queryMarblesByOwner failed", res.Message)
+		t.FailNow()
+	}
+	checkQueryKeys(t, res.Payload)
+	if richStub.queries[0] != `{"selector":{"burned":{"$exists":false},"docType":"marble","owner":"tom\",\"color\":\"red"}}` {
+		fmt.Println("Query was", richStub.queries[0])
+		t.FailNow()
+	}
+	res = new(SimpleChaincode).queryMarblesByOwner(richStub, []string{"tom"})
+	checkQueryKeys(t, res.Payload, `marble"4`, "marble1", "marble3")
+}
+
+func TestMarbles_QueryMarbles(t *testing.T) {
+	stub := &richQueryStub{MockStub: newMarblesStub()}
+	checkInvoke(t, stub.MockStub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub.MockStub, "initMarble", "marble2", "red", "50", "jerry")
+	checkInvoke(t, stub.MockStub, "initMarble", "marble3", "blue", "70", "tom")
+	checkInvoke(t, stub.MockStub, "createCollection", "tom")
+
+	res := new(SimpleChaincode).queryMarbles(stub, []string{`{"selector":{"owner":"tom"},"use_index":"_design/indexOwnerDoc"}`})
+	if res.Status != shim.OK {
+		fmt.Println("queryMarbles failed", res.Message)
+		t.FailNow()
+	}
+	checkQueryKeys(t, res.Payload, "marble1", "marble3")
+
+	// the docType is forced, so other objects cannot be queried
+	res = new(SimpleChaincode).queryMarbles(stub, []string{`{"selector":{"docType":"marbleCollection","owner":"tom"},"use_index":"_design/indexOwnerDoc"}`})
+	if res.Status != shim.OK {
+		fmt.Println("queryMarbles failed", res.Message)
+		t.FailNow()
+	}
+	checkQueryKeys(t, res.Payload, "marble1", "marble3")
+
+	for _, query := range []string{
+		`{"selector":{"owner":"tom"}}`,
+		`{"selector":{"color":"blue"},"use_index":"_design/indexOwnerDoc"}`,
+		`{"selector":{"owner":"tom","$or":[{"size":35}]},"use_index":"_design/indexOwnerDoc"}`,
+		`{"selector":{"owner":"tom","name":{"$regex":"marble"}},"use_index":"_design/indexOwnerDoc"}`,
+		`{"selector":{"owner":"tom"},"use_index":"_design/indexOwnerDoc","skip":10}`,
+		`not json`,
+	} {
+		res = new(SimpleChaincode).queryMarbles(stub, []string{query})
+		if res.Status == shim.OK {
+			fmt.Println("queryMarbles", query, "should have failed")
+			t.FailNow()
+		}
+	}
+	if len(stub.queries) != 2 {
+		fmt.Println("Rejected queries reached the state database", stub.queries)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_InitMarbles(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	payload := checkInvoke(t, stub, "initMarbles", `[
+		{"name":"marble2","color":"Red","size":50,"owner":"Jerry"},
+		{"name":"marble1","color":"red","size":50,"owner":"tom"},
+		{"name":"marble3","color":"blue","size":"big","owner":"tom"},
+		{"name":"marble3","color":"blue","size":"70","owner":"tom"},
+		{"name":"marble3","color":"green","size":10,"owner":"tom"},
+		{"name":"marble4","color":"","size":10,"owner":"tom"},
+		{"name":"marble5","color":"blue","size":7.5,"owner":"tom"},
+		"marble6"
+	]`)
+	var results []initMarblesResult
+	err := json.Unmarshal(payload, &results)
+	if err != nil {
+		fmt.Println("initMarbles returned", string(payload))
+		t.FailNow()
+	}
+	expected := []struct {
+		name    string
+		created bool
+		error   string
+	}{
+		{"marble2", true, ""},
+		{"marble1", false, "This marble already exists: marble1"},
+		{"marble3", false, "size must be an integer"},
+		{"marble3", true, ""},
+		{"marble3", false, "This marble is already created by this transaction: marble3"},
+		{"marble4", false, "color must be a non-empty string"},
+		{"marble5", false, "size must be an integer"},
+		{"", false, "spec 7 is not a marble spec"},
+	}
+	if len(results) != len(expected) {
+		fmt.Println("initMarbles returned", string(payload))
+		t.FailNow()
+	}
+	for i, result := range results {
+		if result.Name != expected[i].name || result.Created != expected[i].created || !strings.HasPrefix(result.Error, expected[i].error) {
+			fmt.Println("initMarbles result", i, "was", result, "not", expected[i])
+			t.FailNow()
+		}
+	}
+
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+	checkMarble(t, stub, "marble2", "red", 50, "jerry", tom)
+	checkMarble(t, stub, "marble3", "blue", 70, "tom", tom)
+	checkNoState(t, stub, "marble4")
+	checkNoState(t, stub, "marble5")
+	checkIndexEntry(t, stub, "color~name", []string{"red", "marble2"}, true)
+	checkIndexEntry(t, stub, "color~name", []string{"blue", "marble3"}, true)
+	checkIndexEntry(t, stub, "color~name", []string{"green", "marble3"}, false)
+	checkIndexEntry(t, stub, "owner~name", []string{"jerry", "marble2"}, true)
+
+	checkInvokeFails(t, stub, "must be a JSON array of marble specs", "initMarbles", `{"name":"marble9"}`)
+	checkInvokeFails(t, stub, "must hold at least one marble spec", "initMarbles", `[]`)
+	checkInvokeFails(t, stub, "Incorrect number of arguments. Expecting 1", "initMarbles")
+}
+
+func checkMintedProvenance(t *testing.T, stub *shim.MockStub, name string, color string, edition int) *marbleProvenance {
+	var m marble
+	err := json.Unmarshal(stub.State[name], &m)
+	if err != nil || m.Provenance == nil {
+		fmt.Println("Marble", name, "has no provenance", string(stub.State[name]))
+		t.FailNow()
+	}
+	if m.Provenance.MintTxID != "1" || m.Provenance.Color != color || m.Provenance.Edition != edition {
+		fmt.Println("Marble", name, "provenance was", *m.Provenance, "not", color, edition)
+		t.FailNow()
+	}
+	return m.Provenance
+}
+
+// mintWrite is the history entry of the transaction that minted a marble
+func mintWrite(t *testing.T, value []byte, provenance *marbleProvenance) *queryresult.KeyModification {
+	mintTime, err := time.Parse(time.RFC3339Nano, provenance.MintTimestamp)
+	if err != nil {
+		fmt.Println("Invalid mint timestamp", provenance.MintTimestamp)
+		t.FailNow()
+	}
+	return &queryresult.KeyModification{
+		TxId:      provenance.MintTxID,
+		Value:     value,
+		Timestamp: &timestamp.Timestamp{Seconds: mintTime.Unix(), Nanos: int32(mintTime.Nanosecond())},
+	}
+}
+
+func checkVerifyProvenance(t *testing.T, stub *historyStub, name string, expectedProblems ...string) {
+	res := new(SimpleChaincode).verifyProvenance(stub, []string{name})
+	if res.Status != shim.OK {
+		fmt.Println("verifyProvenance", name, "failed", res.Message)
+		t.FailNow()
+	}
+	var report provenanceReport
+	err := json.Unmarshal(res.Payload, &report)
+	if err != nil {
+		fmt.Println("verifyProvenance returned", string(res.Payload))
+		t.FailNow()
+	}
+	if expectedProblems == nil {
+		expectedProblems = []string{}
+	}
+	if report.Valid != (len(expectedProblems) == 0) || !reflect.DeepEqual(report.Problems, expectedProblems) {
+		fmt.Println("verifyProvenance", name, "returned", string(res.Payload), "not", expectedProblems)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_Provenance(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarbles", `[
+		{"name":"marble2","color":"blue","size":50,"owner":"tom"},
+		{"name":"marble1","color":"blue","size":50,"owner":"tom"},
+		{"name":"marble3","color":"red","size":50,"owner":"tom"},
+		{"name":"marble4","color":"Blue","size":50,"owner":"tom"}
+	]`)
+	provenance := checkMintedProvenance(t, stub, "marble1", "blue", 1)
+	checkMintedProvenance(t, stub, "marble2", "blue", 2)
+	checkMintedProvenance(t, stub, "marble3", "red", 1)
+	checkMintedProvenance(t, stub, "marble4", "blue", 3)
+
+	// provenance survives changes to the marble
+	checkInvoke(t, stub, "updateMarble", "marble1", "1", `{"color":"green"}`)
+	checkInvoke(t, stub, "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+	if p := checkMintedProvenance(t, stub, "marble1", "blue", 1); *p != *provenance {
+		fmt.Println("Provenance changed from", *provenance, "to", *p)
+		t.FailNow()
+	}
+
+	// edition numbers are not reused
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "delete", "marble1")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "jerry")
+	checkMintedProvenance(t, stub, "marble1", "blue", 4)
+
+	minted := stub.State["marble2"]
+	history := &historyStub{MockStub: stub, history: map[string][]*queryresult.KeyModification{}}
+	history.history["marble2"] = []*queryresult.KeyModification{mintWrite(t, minted, checkMintedProvenance(t, stub, "marble2", "blue", 2))}
+	checkVerifyProvenance(t, history, "marble2")
+
+	// only the writes since the last delete count
+	history.history["marble1"] = []*queryresult.KeyModification{
+		mintWrite(t, minted, provenance),
+		{TxId: "2", IsDelete: true},
+		mintWrite(t, stub.State["marble1"], checkMintedProvenance(t, stub, "marble1", "blue", 4)),
+	}
+	checkVerifyProvenance(t, history, "marble1")
+
+	// a record whose provenance was rewritten outside initMarble
+	var forged marble
+	json.Unmarshal(minted, &forged)
+	forged.Provenance.Edition = 7
+	stub.State["marble2"], _ = json.Marshal(forged)
+	checkVerifyProvenance(t, history, "marble2",
+		"provenance has changed since the marble was minted",
+		"edition 7 of blue marbles has not been minted")
+
+	// a record that claims to be minted by another transaction
+	forged.Provenance.Edition = 2
+	forged.Provenance.MintTxID = "9"
+	stub.State["marble2"], _ = json.Marshal(forged)
+	checkVerifyProvenance(t, history, "marble2",
+		"marble was first written by transaction 1, not 9",
+		"provenance has changed since the marble was minted")
+
+	// a record without provenance
+	stub.State["marble5"] = []byte(`{"docType":"marble","name":"marble5","color":"blue","size":1,"owner":"tom"}`)
+	checkVerifyProvenance(t, history, "marble5", "marble has no provenance")
+	checkVerifyProvenance(t, history, "marble3", "marble has no history")
+}
+
+func TestMarbles_BurnMarble(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "blue", "50", "tom")
+	checkInvoke(t, stub, "createCollection", "favourites")
+	checkInvoke(t, stub, "addToCollection", "favourites", "marble1")
+
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "burnMarble", "marble1", "chipped")
+
+	setSubmitter(tom, nil)
+	payload := checkInvoke(t, stub, "burnMarble", "marble1", "chipped")
+	if string(payload) != string(stub.State["marble1"]) {
+		fmt.Println("burnMarble returned", string(payload))
+		t.FailNow()
+	}
+
+	// the tombstone stays under the marble's key
+	var tombstone marble
+	err := json.Unmarshal(stub.State["marble1"], &tombstone)
+	if err != nil || tombstone.Burned == nil {
+		fmt.Println("Marble marble1 has no tombstone", string(stub.State["marble1"]))
+		t.FailNow()
+	}
+	if tombstone.Burned.BurnedBy != tom || tombstone.Burned.TxID != "1" || tombstone.Burned.Reason != "chipped" || tombstone.Burned.BurnedAt == "" {
+		fmt.Println("Marble marble1 tombstone was", *tombstone.Burned)
+		t.FailNow()
+	}
+	if tombstone.Name != "marble1" || tombstone.Color != "blue" || tombstone.Version != 2 {
+		fmt.Println("Marble marble1 tombstone lost the marble", string(stub.State["marble1"]))
+		t.FailNow()
+	}
+	checkIndexEntry(t, stub, "color~name", []string{"blue", "marble1"}, false)
+	checkIndexEntry(t, stub, "owner~name", []string{"tom", "marble1"}, false)
+	checkIndexEntry(t, stub, "identity~name", []string{tom.MSPID, tom.ID, "marble1"}, false)
+	checkIndexEntry(t, stub, "collection~name", []string{"favourites", "marble1"}, false)
+	checkInvoke(t, stub, "readMarble", "marble1")
+
+	// a burned marble can no longer be changed, deleted or minted again
+	checkInvokeFails(t, stub, "Marble marble1 was burned", "burnMarble", "marble1")
+	checkInvokeFails(t, stub, "Marble marble1 was burned", "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+	checkInvokeFails(t, stub, "Marble marble1 was burned", "updateMarble", "marble1", "2", `{"size":40}`)
+	checkInvokeFails(t, stub, "Marble marble1 was burned, its tombstone cannot be deleted", "delete", "marble1")
+	checkInvokeFails(t, stub, "This marble was burned and cannot be minted again: marble1", "initMarble", "marble1", "blue", "35", "tom")
+	payload = checkInvoke(t, stub, "initMarbles", `[{"name":"marble1","color":"blue","size":35,"owner":"tom"}]`)
+	if !strings.Contains(string(payload), "This marble was burned and cannot be minted again: marble1") {
+		fmt.Println("initMarbles returned", string(payload))
+		t.FailNow()
+	}
+
+	// burned marbles are left out of color transfers and queries
+	checkInvoke(t, stub, "transferMarblesBasedOnColor", "blue", "jerry", jerry.MSPID, jerry.ID)
+	checkMarble(t, stub, "marble2", "blue", 50, "jerry", jerry)
+	checkQueryKeys(t, checkInvoke(t, stub, "getMarblesByRange", "marble1", "marble9"), "marble2")
+	checkQueryKeys(t, checkInvoke(t, stub, "getMarblesByRange", "marble1", "marble9", "true"), "marble1", "marble2")
+	checkInvokeFails(t, stub, "3rd argument must be true or false", "getMarblesByRange", "marble1", "marble9", "maybe")
+
+	query := `{"selector":{"color":"blue"},"use_index":"_design/indexColorDoc"}`
+	richStub := &richQueryStub{MockStub: stub}
+	res := new(SimpleChaincode).queryMarbles(richStub, []string{query})
+	if res.Status != shim.OK {
+		fmt.Println("queryMarbles failed", res.Message)
+		t.FailNow()
+	}
+	checkQueryKeys(t, res.Payload, "marble2")
+	res = new(SimpleChaincode).queryMarbles(richStub, []string{query, "true"})
+	if res.Status != shim.OK {
+		fmt.Println("queryMarbles failed", res.Message)
+		t.FailNow()
+	}
+	checkQueryKeys(t, res.Payload, "marble1", "marble2")
+
+	checkInvokeFails(t, stub, "Incorrect number of arguments. Expecting 1 or 2", "burnMarble")
+}
+
+func TestMarbles_Config(t *testing.T) {
+	stub := newMarblesStub()
+
+	res := stub.MockInit("1", [][]byte{[]byte("init"), []byte(`{"maxMarblesPerOwner":2,"allowedColors":["Blue","red"],"minSize":10,"maxSize":50}`)})
+	if res.Status != shim.OK {
+		fmt.Println("Init failed", res.Message)
+		t.FailNow()
+	}
+	payload := checkInvoke(t, stub, "readConfig")
+	if string(payload) != `{"maxMarblesPerOwner":2,"allowedColors":["blue","red"],"minSize":10,"maxSize":50}` {
+		fmt.Println("readConfig returned", string(payload))
+		t.FailNow()
+	}
+
+	// an upgrade without a config keeps the current one
+	res = stub.MockInit("2", [][]byte{[]byte("init")})
+	if res.Status != shim.OK || string(checkInvoke(t, stub, "readConfig")) != string(payload) {
+		fmt.Println("Init without config changed the config", res.Message)
+		t.FailNow()
+	}
+	res = stub.MockInit("3", [][]byte{[]byte("init"), []byte(`{"maxMarbles":2}`)})
+	if res.Status == shim.OK {
+		fmt.Println("Init with an unknown rule should have failed")
+		t.FailNow()
+	}
+
+	checkInvokeFails(t, stub, "Color green is not allowed, allowed colors are blue, red", "initMarble", "marble1", "green", "35", "tom")
+	checkInvokeFails(t, stub, "Size 5 is below the minimum size of 10", "initMarble", "marble1", "blue", "5", "tom")
+	checkInvokeFails(t, stub, "Size 60 is above the maximum size of 50", "initMarble", "marble1", "blue", "60", "tom")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "tom")
+	// the quota is counted against the owning identity, whatever owner name is given
+	checkInvokeFails(t, stub, "Owner tom's id of Org1MSP has 2 marbles, the maximum is 2", "initMarble", "marble3", "blue", "35", "alice")
+	checkInvokeFails(t, stub, "Color green is not allowed", "updateMarble", "marble1", "1", `{"color":"green"}`)
+
+	// marbles minted earlier in the same transaction count against the quota
+	setSubmitter(jerry, nil)
+	payload = checkInvoke(t, stub, "initMarbles", `[
+		{"name":"marble3","color":"blue","size":35,"owner":"jerry"},
+		{"name":"marble4","color":"green","size":35,"owner":"jerry"},
+		{"name":"marble5","color":"blue","size":35,"owner":"jerry"},
+		{"name":"marble6","color":"blue","size":35,"owner":"bob"}
+	]`)
+	var results []initMarblesResult
+	json.Unmarshal(payload, &results)
+	if len(results) != 4 || !results[0].Created || results[1].Created || !results[2].Created || results[3].Error != "Owner jerry's id of Org2MSP has 2 marbles, the maximum is 2" {
+		fmt.Println("initMarbles returned", string(payload))
+		t.FailNow()
+	}
+	checkIndexEntry(t, stub, "identity~name", []string{jerry.MSPID, jerry.ID, "marble3"}, true)
+
+	setSubmitter(tom, nil)
+	checkInvokeFails(t, stub, "Owner jerry's id of Org2MSP has 2 marbles, the maximum is 2", "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+
+	// only admins can change the rules
+	checkInvokeFails(t, stub, "Only admins can update the config", "updateConfig", `{"maxMarblesPerOwner":3}`)
+	setSubmitter(tom, map[string]string{"marbles.admin": "true"})
+	checkInvokeFails(t, stub, "minSize must not be above maxSize", "updateConfig", `{"minSize":10,"maxSize":5}`)
+	checkInvoke(t, stub, "updateConfig", `{"maxMarblesPerOwner":3}`)
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "initMarble", "marble7", "green", "1", "tom")
+	checkInvoke(t, stub, "updateMarble", "marble7", "1", `{"size":500}`)
+	checkInvoke(t, stub, "transferMarble", "marble2", "jerry", jerry.MSPID, jerry.ID)
+	checkMarble(t, stub, "marble2", "red", 50, "jerry", jerry)
+	checkIndexEntry(t, stub, "identity~name", []string{tom.MSPID, tom.ID, "marble2"}, false)
+	checkIndexEntry(t, stub, "identity~name", []string{jerry.MSPID, jerry.ID, "marble2"}, true)
+
+	// an admin moves the four blue marbles, two of tom's and two of jerry's, to bob's identity
+	// under the owner name jerry. The quota is counted against bob's identity, so the fourth
+	// marble takes it over the quota even though the name jerry is given.
+	// MockStub does not roll back failed transactions, so this comes last.
+	checkInvoke(t, stub, "initMarble", "marble8", "blue", "20", "tom")
+	bob := marbleIdentity{MSPID: "Org2MSP", ID: "bob's id"}
+	setSubmitter(tom, map[string]string{"marbles.admin": "true"})
+	checkInvokeFails(t, stub, "Transfer failed: Owner bob's id of Org2MSP has 3 marbles, the maximum is 3", "transferMarblesBasedOnColor", "blue", "jerry", bob.MSPID, bob.ID)
+}
+
+// transientStub adds the transient map and private data hashes, which MockStub does not
+// support, to the stub the chaincode is invoked with
+type transientStub struct {
+	*shim.MockStub
+	transient map[string][]byte
+}
+
+func (stub *transientStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+// GetPrivateDataHash hashes the private data MockStub stores, as the peer does
+func (stub *transientStub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	value, err := stub.GetPrivateData(collection, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+// transientChaincode invokes the marbles chaincode through a transientStub, passing it
+// transient as the transient map of every following transaction
+type transientChaincode struct {
+	SimpleChaincode
+	transient map[string][]byte
+}
+
+func (cc *transientChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return cc.SimpleChaincode.Invoke(&transientStub{MockStub: stub.(*shim.MockStub), transient: cc.transient})
+}
+
+func newTransientStub() (*shim.MockStub, *transientChaincode) {
+	setSubmitter(tom, nil)
+	cc := new(transientChaincode)
+	return shim.NewMockStub("marbles", cc), cc
+}
+
+// setBid puts a sealed bid in the transient map of the following transactions
+func setBid(cc *transientChaincode, price int, salt string) {
+	bytes, _ := json.Marshal(&sealedBid{Price: price, Salt: salt})
+	cc.transient = map[string][]byte{"bid": bytes}
+}
+
+// moveAuctionDeadlines rewrites the deadlines of an auction, relative to now in seconds
+func moveAuctionDeadlines(t *testing.T, stub *shim.MockStub, auctionID string, biddingEnds int64, revealEnds int64) {
+	var auction marbleAuction
+	rewriteState(t, stub, "marbleAuction", auctionID, &auction, func() {
+		auction.BiddingEnds = time.Now().Unix() + biddingEnds
+		auction.RevealEnds = time.Now().Unix() + revealEnds
+	})
+}
+
+// rewriteState decodes the object stored under a composite key into object, lets change
+// modify it and stores it again, e.g. to move a deadline into the past
+func rewriteState(t *testing.T, stub *shim.MockStub, objectType string, id string, object interface{}, change func()) {
+	key, _ := stub.CreateCompositeKey(objectType, []string{id})
+	err := json.Unmarshal(stub.State[key], object)
+	if err != nil {
+		fmt.Println(objectType, id, "not found")
+		t.FailNow()
+	}
+	change()
+	stub.State[key], _ = json.Marshal(object)
+}
+
+func checkAuction(t *testing.T, payload []byte, status string, outcome string, winner marbleIdentity, price int) {
+	var auction marbleAuction
+	json.Unmarshal(payload, &auction)
+	if auction.Status != status || auction.Outcome != outcome || auction.WinnerIdentity != winner || auction.WinningPrice != price {
+		fmt.Println("Auction was", string(payload), "not", status, outcome, winner, price)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_Auction(t *testing.T) {
+	stub, cc := newTransientStub()
+	bob := marbleIdentity{MSPID: "Org2MSP", ID: "bob's id"}
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "tom")
+
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "openAuction", "marble1")
+	setSubmitter(tom, nil)
+	checkInvokeFails(t, stub, "3rd argument must be a positive numeric string", "openAuction", "marble1", "10", "0", "60")
+	payload := checkInvoke(t, stub, "openAuction", "marble1", "10", "3600", "3600")
+	checkAuction(t, payload, auctionBidding, "", marbleIdentity{}, 0)
+	checkInvokeFails(t, stub, "Marble marble1 is up for auction 1", "openAuction", "marble1")
+
+	// the marble is locked until the auction is closed
+	checkInvokeFails(t, stub, "Marble marble1 is up for auction 1", "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+	checkInvokeFails(t, stub, "Marble marble1 is up for auction 1", "delete", "marble1")
+	checkInvokeFails(t, stub, "Marble marble1 is up for auction 1", "burnMarble", "marble1")
+	checkInvokeFails(t, stub, "Marble marble1 is up for auction 1", "updateMarble", "marble1", "1", `{"size":40}`)
+	checkInvokeFails(t, stub, "Marble marble1 is up for auction 1", "escrowMarble", "marble1", "bob", jerry.MSPID, jerry.ID, "60")
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+
+	// bids are sealed, and only the seller can move the auction on before the deadline
+	setBid(cc, 20, "a long random salt")
+	checkInvokeFails(t, stub, "The seller cannot bid on their own marble", "submitBid", "1", "tom")
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "submitBid", "1", "jerry")
+	checkInvokeFails(t, stub, "Only the seller can move the auction on before", "startReveal", "1")
+	checkInvokeFails(t, stub, "Auction 1 is bidding, not revealing", "revealBid", "1")
+	setSubmitter(bob, nil)
+	setBid(cc, 30, "another long random salt")
+	checkInvoke(t, stub, "submitBid", "1", "bob")
+
+	// once the bidding deadline has passed no more bids are taken, and anyone can start the reveal
+	moveAuctionDeadlines(t, stub, "1", -1, 3600)
+	setSubmitter(marbleIdentity{MSPID: "Org3MSP", ID: "late bidder's id"}, nil)
+	checkInvokeFails(t, stub, "Bidding on auction 1 closed at", "submitBid", "1", "late")
+	checkInvoke(t, stub, "startReveal", "1")
+	checkInvokeFails(t, stub, "Auction 1 is revealing, not bidding", "startReveal", "1")
+
+	// a reveal must match the commitment
+	setSubmitter(bob, nil)
+	setBid(cc, 40, "another long random salt")
+	checkInvokeFails(t, stub, "does not match", "revealBid", "1")
+	setBid(cc, 30, "another long random salt")
+	checkInvoke(t, stub, "revealBid", "1")
+	checkInvokeFails(t, stub, "Only the seller can move the auction on before", "closeAuction", "1")
+
+	// jerry does not reveal in time, anyone can close the auction once reveals are over
+	moveAuctionDeadlines(t, stub, "1", -2, -1)
+	setSubmitter(jerry, nil)
+	setBid(cc, 20, "a long random salt")
+	checkInvokeFails(t, stub, "Revealing bids of auction 1 closed at", "revealBid", "1")
+	payload = checkInvoke(t, stub, "closeAuction", "1")
+	checkAuction(t, payload, auctionClosed, "sold", bob, 30)
+	checkMarble(t, stub, "marble1", "blue", 35, "bob", bob)
+	checkInvokeFails(t, stub, "Auction 1 is closed, not revealing", "closeAuction", "1")
+
+	// the lock is released, the new owner can transfer the marble
+	setSubmitter(bob, nil)
+	checkInvoke(t, stub, "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+}
+
+func TestMarbles_AuctionWithoutReveal(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "escrowMarble", "marble1", "jerry", jerry.MSPID, jerry.ID, "60")
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow", "openAuction", "marble1")
+	stub, cc := newTransientStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "openAuction", "marble1")
+
+	setSubmitter(jerry, nil)
+	setBid(cc, 20, "a long random salt")
+	checkInvoke(t, stub, "submitBid", "1", "jerry")
+	checkInvokeFails(t, stub, "Auction 1 is bidding, not revealing", "closeAuction", "1")
+
+	// the seller never started the reveal phase, once both deadlines have passed anyone can close
+	moveAuctionDeadlines(t, stub, "1", -2, -1)
+	payload := checkInvoke(t, stub, "closeAuction", "1")
+	checkAuction(t, payload, auctionClosed, "no valid bids", marbleIdentity{}, 0)
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "delete", "marble1")
+}
+
+// checkEvent checks the name of the last event set and returns its payload
+func checkEvent(t *testing.T, stub *shim.MockStub, name string) []byte {
+	var payload []byte
+	found := ""
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		event := <-stub.ChaincodeEventsChannel
+		found, payload = event.EventName, event.Payload
+	}
+	if found != name {
+		fmt.Println("Event was", found, "not", name)
+		t.FailNow()
+	}
+	return payload
+}
+
+func TestMarbles_Trade(t *testing.T) {
+	stub := newMarblesStub()
+	bob := marbleIdentity{MSPID: "Org2MSP", ID: "bob's id"}
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "jerry")
+
+	// only the owner of the offered marble can propose
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "proposeTrade", "marble1", "marble2", "3600")
+	setSubmitter(tom, nil)
+	checkInvokeFails(t, stub, "A marble cannot be traded for itself", "proposeTrade", "marble1", "marble1", "3600")
+	checkInvokeFails(t, stub, "3rd argument must be a positive numeric string", "proposeTrade", "marble1", "marble2", "-1")
+	checkInvokeFails(t, stub, "Marble does not exist: marble3", "proposeTrade", "marble1", "marble3", "3600")
+	checkInvoke(t, stub, "proposeTrade", "marble1", "marble2", "3600", "10")
+
+	// only the owner of the requested marble can accept, and only the parties can cancel
+	checkInvokeFails(t, stub, "Only the owner of marble marble2", "acceptTrade", "1")
+	setSubmitter(bob, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble2", "acceptTrade", "1")
+	checkInvokeFails(t, stub, "Only the parties to trade 1 can cancel it", "cancelTrade", "1")
+
+	// a locked marble cannot be traded
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "escrowMarble", "marble2", "bob", bob.MSPID, bob.ID, "3600")
+	checkInvokeFails(t, stub, "Marble marble2 is held in escrow for bob", "acceptTrade", "1")
+	setSubmitter(bob, nil)
+	checkInvoke(t, stub, "cancelEscrow", "marble2")
+
+	setSubmitter(jerry, nil)
+	payload := checkInvoke(t, stub, "acceptTrade", "1")
+	var trade marbleTrade
+	json.Unmarshal(payload, &trade)
+	if trade.Status != tradeAccepted || trade.Price != 10 {
+		fmt.Println("acceptTrade returned", string(payload))
+		t.FailNow()
+	}
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+	checkMarble(t, stub, "marble2", "red", 50, "tom", tom)
+	var batch marbleBatchTransfer
+	json.Unmarshal(checkEvent(t, stub, marblesTransferredEvent), &batch)
+	if len(batch.Transfers) != 2 || batch.Transfers[0].NewOwnerIdentity != jerry || batch.Transfers[1].NewOwnerIdentity != tom {
+		fmt.Println("acceptTrade event was", batch)
+		t.FailNow()
+	}
+	checkInvokeFails(t, stub, "Trade 1 has already been accepted", "acceptTrade", "1")
+	checkInvokeFails(t, stub, "Trade 1 has already been accepted", "cancelTrade", "1")
+
+	// an expired trade cannot be accepted, but can still be declined
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "proposeTrade", "marble2", "marble1", "60")
+	rewriteState(t, stub, "marbleTrade", "1", &trade, func() {
+		trade.Expires = time.Now().Unix() - 1
+	})
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Trade 1 expired at", "acceptTrade", "1")
+	checkInvoke(t, stub, "cancelTrade", "1")
+	checkInvokeFails(t, stub, "Trade 1 has already been cancelled", "acceptTrade", "1")
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+	checkMarble(t, stub, "marble2", "red", 50, "tom", tom)
+}
+
+// paginationStub pages the results of range, composite key and rich queries, which
+// MockStub does not paginate. A bookmark is the key the next page starts at.
+type paginationStub struct {
+	*richQueryStub
+}
+
+func newPaginationStub() *paginationStub {
+	return &paginationStub{richQueryStub: &richQueryStub{MockStub: newMarblesStub()}}
+}
+
+func (stub *paginationStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := stub.GetStateByRange(startKey, endKey)
+	return page(iter, err, pageSize, bookmark)
+}
+
+func (stub *paginationStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(objectType, keys)
+	return page(iter, err, pageSize, bookmark)
+}
+
+func (stub *paginationStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := stub.GetQueryResult(query)
+	return page(iter, err, pageSize, bookmark)
+}
+
+func page(iter shim.StateQueryIteratorInterface, err error, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	result := &stateIterator{}
+	metadata := &pb.QueryResponseMetadata{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.Key < bookmark {
+			continue
+		}
+		if len(result.kvs) == int(pageSize) {
+			metadata.Bookmark = kv.Key
+			break
+		}
+		result.kvs = append(result.kvs, kv)
+	}
+	metadata.FetchedRecordsCount = int32(len(result.kvs))
+	return result, metadata, nil
+}
+
+// checkQueryPage checks the keys and the bookmark of a page of query results
+func checkQueryPage(t *testing.T, res pb.Response, bookmark string, expectedKeys ...string) {
+	if res.Status != shim.OK {
+		fmt.Println("Query failed", res.Message)
+		t.FailNow()
+	}
+	var page struct {
+		Records          json.RawMessage
+		ResponseMetadata marbleStatsPage
+	}
+	err := json.Unmarshal(res.Payload, &page)
+	if err != nil {
+		fmt.Println("Query page is not valid JSON", string(res.Payload))
+		t.FailNow()
+	}
+	checkQueryKeys(t, page.Records, expectedKeys...)
+	if page.ResponseMetadata.Bookmark != bookmark || int(page.ResponseMetadata.RecordsCount) != len(expectedKeys) {
+		fmt.Println("Query page metadata was", page.ResponseMetadata, "not bookmark", bookmark, "with", len(expectedKeys), "records")
+		t.FailNow()
+	}
+}
+
+func TestMarbles_Pagination(t *testing.T) {
+	stub := newPaginationStub()
+	for _, name := range []string{"marble1", "marble2", "marble3", "marble4", "marble5"} {
+		checkInvoke(t, stub.MockStub, "initMarble", name, "blue", "35", "tom")
+	}
+	checkInvoke(t, stub.MockStub, "burnMarble", "marble3")
+
+	// burned marbles are left out of the page, but still take up room in it
+	chaincode := new(SimpleChaincode)
+	checkQueryPage(t, chaincode.getMarblesByRangeWithPagination(stub, []string{"marble1", "marble9", "2", ""}), "marble3", "marble1", "marble2")
+	checkQueryPage(t, chaincode.getMarblesByRangeWithPagination(stub, []string{"marble1", "marble9", "2", "marble3"}), "marble5", "marble4")
+	checkQueryPage(t, chaincode.getMarblesByRangeWithPagination(stub, []string{"marble1", "marble9", "2", "marble3", "true"}), "marble5", "marble3", "marble4")
+	checkQueryPage(t, chaincode.getMarblesByRangeWithPagination(stub, []string{"marble1", "marble9", "2", "marble5"}), "", "marble5")
+	res := chaincode.getMarblesByRangeWithPagination(stub, []string{"marble1", "marble9", "0", ""})
+	if res.Status == shim.OK || res.Message != "page size must be a positive numeric string" {
+		fmt.Println("getMarblesByRangeWithPagination should have failed, not", res.Message)
+		t.FailNow()
+	}
+
+	query := `{"selector":{"owner":"tom"},"use_index":"_design/indexOwnerDoc"}`
+	checkQueryPage(t, chaincode.queryMarblesWithPagination(stub, []string{query, "2", ""}), "marble4", "marble1", "marble2")
+	checkQueryPage(t, chaincode.queryMarblesWithPagination(stub, []string{query, "2", "marble4"}), "", "marble4", "marble5")
+	checkQueryPage(t, chaincode.queryMarblesWithPagination(stub, []string{query, "2", "marble2", "true"}), "marble4", "marble2", "marble3")
+	res = chaincode.queryMarblesWithPagination(stub, []string{query, "101", ""})
+	if res.Status == shim.OK || res.Message != "page size must be at most 100" {
+		fmt.Println("queryMarblesWithPagination should have failed, not", res.Message)
+		t.FailNow()
+	}
+}
+
+func TestMarbles_UpdateMarble(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	payload := checkInvoke(t, stub, "updateMarble", "marble1", "1", `{"color":"Green","size":40}`)
+	checkMarble(t, stub, "marble1", "green", 40, "tom", tom)
+	checkIndexEntry(t, stub, "color~name", []string{"blue", "marble1"}, false)
+	checkIndexEntry(t, stub, "color~name", []string{"green", "marble1"}, true)
+	var updated marble
+	json.Unmarshal(payload, &updated)
+	if updated.Version != 2 || updated.Color != "green" {
+		fmt.Println("updateMarble returned", string(payload))
+		t.FailNow()
+	}
+
+	// an update based on an old read is rejected
+	checkInvokeFails(t, stub, "Marble marble1 is at version 2, not 1. Read it again and retry", "updateMarble", "marble1", "1", `{"size":50}`)
+
+	checkInvokeFails(t, stub, "Field owner cannot be updated", "updateMarble", "marble1", "2", `{"owner":"jerry"}`)
+	checkInvokeFails(t, stub, "Patch must change at least one field", "updateMarble", "marble1", "2", `{}`)
+	checkInvokeFails(t, stub, "Failed to decode JSON of patch", "updateMarble", "marble1", "2", `not json`)
+	checkInvokeFails(t, stub, "size must be a number", "updateMarble", "marble1", "2", `{"size":"big"}`)
+	checkInvokeFails(t, stub, "color must be a non-empty string", "updateMarble", "marble1", "2", `{"color":""}`)
+	checkInvokeFails(t, stub, "2nd argument must be a numeric string", "updateMarble", "marble1", "latest", `{"size":50}`)
+	checkInvokeFails(t, stub, "Marble does not exist: marble2", "updateMarble", "marble2", "1", `{"size":50}`)
+
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "updateMarble", "marble1", "2", `{"size":50}`)
+	checkMarble(t, stub, "marble1", "green", 40, "tom", tom)
+}
+
+func TestMarbles_Collections(t *testing.T) {
+	stub := newMarblesStub()
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "tom")
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "initMarble", "marble3", "blue", "70", "jerry")
+
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "createCollection", "favourites")
+	checkInvokeFails(t, stub, "This collection already exists: favourites", "createCollection", "favourites")
+	checkInvoke(t, stub, "addToCollection", "favourites", "marble1")
+	checkInvoke(t, stub, "addToCollection", "favourites", "marble2")
+	checkInvokeFails(t, stub, "Only the owner of marble marble3 can add it to a collection", "addToCollection", "favourites", "marble3")
+	checkInvokeFails(t, stub, "Collection does not exist: shelf", "addToCollection", "shelf", "marble1")
+	checkQueryKeys(t, checkInvoke(t, stub, "queryCollection", "favourites"), "marble1", "marble2")
+	checkIndexEntry(t, stub, "collection~name", []string{tom.MSPID, tom.ID, "favourites", "marble1"}, true)
+	checkIndexEntry(t, stub, "name~collection", []string{"marble1", tom.MSPID, tom.ID, "favourites"}, true)
+
+	// collection names are per owner, and only the owners can take marbles out
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Collection does not exist: favourites", "addToCollection", "favourites", "marble3")
+	checkInvoke(t, stub, "createCollection", "favourites")
+	checkInvoke(t, stub, "addToCollection", "favourites", "marble3")
+	checkQueryKeys(t, checkInvoke(t, stub, "queryCollection", "favourites"), "marble3")
+	checkQueryKeys(t, checkInvoke(t, stub, "queryCollection", "favourites", tom.MSPID, tom.ID), "marble1", "marble2")
+	checkInvokeFails(t, stub, "is not allowed to do this", "removeFromCollection", "favourites", "marble1")
+
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "removeFromCollection", "favourites", "marble2")
+	checkInvokeFails(t, stub, "Marble marble2 is not in collection favourites", "removeFromCollection", "favourites", "marble2")
+
+	// a marble that changes hands leaves all collections
+	checkInvoke(t, stub, "transferMarble", "marble1", "jerry", jerry.MSPID, jerry.ID)
+	checkQueryKeys(t, checkInvoke(t, stub, "queryCollection", "favourites"))
+	checkIndexEntry(t, stub, "collection~name", []string{tom.MSPID, tom.ID, "favourites", "marble1"}, false)
+	checkIndexEntry(t, stub, "name~collection", []string{"marble1", tom.MSPID, tom.ID, "favourites"}, false)
+	checkQueryKeys(t, checkInvoke(t, stub, "queryCollection", "favourites", jerry.MSPID, jerry.ID), "marble3")
+}
+
+func TestMarbles_PrivateDetails(t *testing.T) {
+	stub, cc := newTransientStub()
+	tomsColleague := marbleIdentity{MSPID: "Org1MSP", ID: "tom's colleague's id"}
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	checkInvokeFails(t, stub, "marble_details must be a key in the transient map", "setMarblePrivateDetails", "marble1")
+	cc.transient = map[string][]byte{"marble_details": []byte(`{"price":99,"appraisal":120,"salt":"short"}`)}
+	checkInvokeFails(t, stub, "salt field must be at least 16 characters", "setMarblePrivateDetails", "marble1")
+	cc.transient = map[string][]byte{"marble_details": []byte(`{"price":0,"appraisal":120,"salt":"a long random string"}`)}
+	checkInvokeFails(t, stub, "price field must be a positive integer", "setMarblePrivateDetails", "marble1")
+	cc.transient = map[string][]byte{"marble_details": []byte(`{"price":99,"appraisal":120,"salt":"a long random string"}`)}
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "setMarblePrivateDetails", "marble1")
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "setMarblePrivateDetails", "marble1")
+
+	// the details are private to the owner's org
+	var details marblePrivateDetails
+	json.Unmarshal(checkInvoke(t, stub, "readMarblePrivateDetails", "marble1"), &details)
+	if details.Price != 99 || details.Appraisal != 120 || details.OwnerIdentity != tom {
+		fmt.Println("readMarblePrivateDetails returned", details)
+		t.FailNow()
+	}
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only members of Org1MSP can read the private details of marble marble1", "readMarblePrivateDetails", "marble1")
+
+	// but any org can check a price it was told against the hash
+	cc.transient = map[string][]byte{"marble_price": []byte(`{"price":99,"salt":"a long random string"}`)}
+	payload := checkInvoke(t, stub, "verifyMarblePrice", "marble1")
+	if string(payload) != `{"name":"marble1","price":99,"verified":true}` {
+		fmt.Println("verifyMarblePrice returned", string(payload))
+		t.FailNow()
+	}
+	cc.transient = map[string][]byte{"marble_price": []byte(`{"price":90,"salt":"a long random string"}`)}
+	checkInvokeFails(t, stub, "Price does not match the private price of marble marble1", "verifyMarblePrice", "marble1")
+	cc.transient = nil
+	checkInvokeFails(t, stub, "marble_price must be a key in the transient map", "verifyMarblePrice", "marble1")
+
+	// the details are bound to the owning identity, even within the same org
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "transferMarble", "marble1", "tom's colleague", tomsColleague.MSPID, tomsColleague.ID)
+	setSubmitter(tomsColleague, nil)
+	checkInvokeFails(t, stub, "Marble private details do not exist: marble1", "readMarblePrivateDetails", "marble1")
+	cc.transient = map[string][]byte{"marble_price": []byte(`{"price":99,"salt":"a long random string"}`)}
+	checkInvokeFails(t, stub, "Price does not match the private price of marble marble1", "verifyMarblePrice", "marble1")
+}
+
+func TestMarbles_Escrow(t *testing.T) {
+	stub := newMarblesStub()
+	bob := marbleIdentity{MSPID: "Org2MSP", ID: "bob's id"}
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	checkInvokeFails(t, stub, "A marble cannot be held in escrow for its own owner", "escrowMarble", "marble1", "tom", tom.MSPID, tom.ID, "3600")
+	checkInvokeFails(t, stub, "5th argument must be a positive numeric string", "escrowMarble", "marble1", "jerry", jerry.MSPID, jerry.ID, "0")
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner of marble marble1", "escrowMarble", "marble1", "jerry", jerry.MSPID, jerry.ID, "3600")
+	setSubmitter(tom, nil)
+	checkInvoke(t, stub, "escrowMarble", "marble1", "jerry", jerry.MSPID, jerry.ID, "3600")
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow for jerry", "escrowMarble", "marble1", "bob", bob.MSPID, bob.ID, "3600")
+
+	// the marble is locked until the escrow is released, cancelled or expires
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow for jerry", "transferMarble", "marble1", "bob", bob.MSPID, bob.ID)
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow for jerry", "delete", "marble1")
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow for jerry", "burnMarble", "marble1")
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow for jerry", "updateMarble", "marble1", "1", `{"size":40}`)
+	checkInvokeFails(t, stub, "Marble marble1 is held in escrow for jerry", "openAuction", "marble1")
+	checkMarble(t, stub, "marble1", "blue", 35, "tom", tom)
+
+	// only the owner releases, and the owner cannot back out before the escrow expires
+	setSubmitter(jerry, nil)
+	checkInvokeFails(t, stub, "Only the owner can release an escrow", "releaseEscrow", "marble1")
+	setSubmitter(tom, nil)
+	checkInvokeFails(t, stub, "Only the counterparty can cancel an escrow before it expires", "cancelEscrow", "marble1")
+	checkInvoke(t, stub, "releaseEscrow", "marble1")
+	checkMarble(t, stub, "marble1", "blue", 35, "jerry", jerry)
+	checkEvent(t, stub, marbleTransferredEvent)
+	checkInvokeFails(t, stub, "Marble is not held in escrow: marble1", "readEscrow", "marble1")
+
+	// an expired escrow no longer locks the marble, and the owner can cancel it
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "escrowMarble", "marble1", "tom", tom.MSPID, tom.ID, "60")
+	var escrow marbleEscrow
+	rewriteState(t, stub, "marbleEscrow", "marble1", &escrow, func() {
+		escrow.Expires = time.Now().Unix() - 1
+	})
+	checkInvokeFails(t, stub, "Escrow of marble1 expired at", "releaseEscrow", "marble1")
+	checkInvoke(t, stub, "updateMarble", "marble1", "2", `{"size":40}`)
+	checkInvoke(t, stub, "cancelEscrow", "marble1")
+	checkInvokeFails(t, stub, "Marble is not held in escrow: marble1", "cancelEscrow", "marble1")
+	checkInvoke(t, stub, "transferMarble", "marble1", "bob", bob.MSPID, bob.ID)
+	checkMarble(t, stub, "marble1", "blue", 40, "bob", bob)
+}
+
+func checkStats(t *testing.T, res pb.Response, expected string) marbleStatsResult {
+	var stats marbleStatsResult
+	if res.Status != shim.OK || json.Unmarshal(res.Payload, &stats) != nil {
+		fmt.Println("marbleStats failed", res.Message)
+		t.FailNow()
+	}
+	// the page is checked by the caller
+	statsJSON, _ := json.Marshal(struct {
+		Total   marbleCount             `json:"total"`
+		ByOwner map[string]*marbleCount `json:"byOwner"`
+		ByColor map[string]*marbleCount `json:"byColor"`
+		Partial bool                    `json:"partial"`
+	}{stats.Total, stats.ByOwner, stats.ByColor, stats.Partial})
+	if string(statsJSON) != expected {
+		fmt.Println("marbleStats returned", string(statsJSON), "not", expected)
+		t.FailNow()
+	}
+	return stats
+}
+
+func TestMarbles_Stats(t *testing.T) {
+	stub := newPaginationStub()
+	checkInvoke(t, stub.MockStub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub.MockStub, "initMarble", "marble2", "red", "50", "jerry")
+	checkInvoke(t, stub.MockStub, "initMarble", "marble3", "blue", "70", "tom")
+	checkInvoke(t, stub.MockStub, "initMarble", "marble4", "green", "10", "tom")
+	checkInvoke(t, stub.MockStub, "burnMarble", "marble4")
+
+	chaincode := new(SimpleChaincode)
+	checkStats(t, chaincode.marbleStats(stub, nil),
+		`{"total":{"count":3,"totalSize":155},"byOwner":{"jerry":{"count":1,"totalSize":50},"tom":{"count":2,"totalSize":105}},"byColor":{"blue":{"count":2,"totalSize":105},"red":{"count":1,"totalSize":50}},"partial":false}`)
+	checkStats(t, chaincode.marbleStats(stub, []string{"Blue"}),
+		`{"total":{"count":2,"totalSize":105},"byOwner":{"tom":{"count":2,"totalSize":105}},"byColor":{"blue":{"count":2,"totalSize":105}},"partial":false}`)
+	checkStats(t, chaincode.marbleStats(stub, []string{"", "tom", "40", ""}),
+		`{"total":{"count":1,"totalSize":70},"byOwner":{"tom":{"count":1,"totalSize":70}},"byColor":{"blue":{"count":1,"totalSize":70}},"partial":false}`)
+
+	// the stats of all marbles are the sum of the stats of the pages, each of them partial
+	stats := checkStats(t, chaincode.marbleStats(stub, []string{"", "", "", "", "2", ""}),
+		`{"total":{"count":2,"totalSize":105},"byOwner":{"tom":{"count":2,"totalSize":105}},"byColor":{"blue":{"count":2,"totalSize":105}},"partial":true}`)
+	if stats.ResponseMetadata.RecordsCount != 2 || stats.ResponseMetadata.Bookmark == "" {
+		fmt.Println("marbleStats page was", stats.ResponseMetadata)
+		t.FailNow()
+	}
+	checkStats(t, chaincode.marbleStats(stub, []string{"", "", "", "", "2", stats.ResponseMetadata.Bookmark}),
+		`{"total":{"count":1,"totalSize":50},"byOwner":{"jerry":{"count":1,"totalSize":50}},"byColor":{"red":{"count":1,"totalSize":50}},"partial":true}`)
+
+	for args, message := range map[string]string{
+		"blue,tom,small":      "3rd argument must be a numeric string",
+		"blue,tom,1,100,1000": "page size must be at most 100",
+		"blue,tom,1,100,none": "page size must be a positive numeric string",
+		"a,b,c,d,e,f,g":       "Incorrect number of arguments. Expecting 0 to 6",
+	} {
+		res := chaincode.marbleStats(stub, strings.Split(args, ","))
+		if res.Status == shim.OK || res.Message != message {
+			fmt.Println("marbleStats", args, "should have failed with", message, "not", res.Message)
+			t.FailNow()
+		}
+	}
+}
+
+func TestMarbles_Events(t *testing.T) {
+	stub := newMarblesStub()
+
+	var created marble
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	json.Unmarshal(checkEvent(t, stub, marbleCreatedEvent), &created)
+	if created.Name != "marble1" || created.OwnerIdentity != tom {
+		fmt.Println("marbleCreated event was", created)
+		t.FailNow()
+	}
+
+	var createdMarbles []marble
+	checkInvoke(t, stub, "initMarbles", `[{"name":"marble2","color":"blue","size":50,"owner":"tom"},{"name":"marble3","color":"red","size":50,"owner":"tom"}]`)
+	json.Unmarshal(checkEvent(t, stub, marblesCreatedEvent), &createdMarbles)
+	if len(createdMarbles) != 2 || createdMarbles[0].Name != "marble2" || createdMarbles[1].Name != "marble3" {
+		fmt.Println("marblesCreated event was", createdMarbles)
+		t.FailNow()
+	}
+
+	var updated marble
+	checkInvoke(t, stub, "updateMarble", "marble1", "1", `{"size":40}`)
+	json.Unmarshal(checkEvent(t, stub, marbleUpdatedEvent), &updated)
+	if updated.Size != 40 || updated.Version != 2 {
+		fmt.Println("marbleUpdated event was", updated)
+		t.FailNow()
+	}
+
+	var transfer marbleTransfer
+	checkInvoke(t, stub, "transferMarble", "marble3", "jerry", jerry.MSPID, jerry.ID)
+	json.Unmarshal(checkEvent(t, stub, marbleTransferredEvent), &transfer)
+	if transfer != (marbleTransfer{Name: "marble3", OldOwner: "tom", OldOwnerIdentity: tom, NewOwner: "jerry", NewOwnerIdentity: jerry}) {
+		fmt.Println("marbleTransferred event was", transfer)
+		t.FailNow()
+	}
+
+	// a transaction that transfers several marbles ends with one event covering them all
+	var batch marbleBatchTransfer
+	checkInvoke(t, stub, "transferMarblesBasedOnColor", "blue", "jerry", jerry.MSPID, jerry.ID)
+	json.Unmarshal(checkEvent(t, stub, marblesTransferredEvent), &batch)
+	if batch.Color != "blue" || len(batch.Transfers) != 2 || batch.Transfers[0].Name != "marble1" || batch.Transfers[1].Name != "marble2" {
+		fmt.Println("marblesTransferred event was", batch)
+		t.FailNow()
+	}
+
+	var burned marble
+	setSubmitter(jerry, nil)
+	checkInvoke(t, stub, "burnMarble", "marble1")
+	json.Unmarshal(checkEvent(t, stub, marbleBurnedEvent), &burned)
+	if burned.Name != "marble1" || burned.Burned == nil {
+		fmt.Println("marbleBurned event was", burned)
+		t.FailNow()
+	}
+
+	var deleted marble
+	checkInvoke(t, stub, "delete", "marble2")
+	json.Unmarshal(checkEvent(t, stub, marbleDeletedEvent), &deleted)
+	if deleted.Name != "marble2" || deleted.OwnerIdentity != jerry {
+		fmt.Println("marbleDeleted event was", deleted)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble collections =================================================================
+// Players group their marbles into named collections. A collection belongs to the
+// submitter that created it, and only holds marbles owned by that same submitter: a
+// marble can only be added by its owner, and it leaves all collections when it is
+// transferred or deleted.
+// Collection names are per owner, so a collection is keyed by the owner's MSP ID and ID
+// followed by its name. Membership is kept in two composite key indexes:
+// collection~name (owner MSP ID, owner ID, collection, marble) lists the marbles of a
+// collection and name~collection (marble, owner MSP ID, owner ID, collection) finds the
+// collections of a marble.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleCollection struct {
+	ObjectType    string         `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name          string         `json:"name"`
+	OwnerIdentity marbleIdentity `json:"ownerIdentity"`
+}
+
+// ============================================================================
+// createCollection - create an empty collection owned by the submitter
+// ============================================================================
+func (t *SimpleChaincode) createCollection(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "favourites"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	collectionName := args[0]
+	owner, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := stub.CreateCompositeKey("marbleCollection", collectionAttributes(owner, collectionName))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	collectionAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get collection: " + err.Error())
+	} else if collectionAsBytes != nil {
+		return shim.Error("This collection already exists: " + collectionName)
+	}
+
+	collection := &marbleCollection{ObjectType: "marbleCollection", Name: collectionName, OwnerIdentity: owner}
+	collectionJSONasBytes, err := json.Marshal(collection)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(key, collectionJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(collectionJSONasBytes)
+}
+
+// ============================================================================
+// addToCollection - add a marble to one of the submitter's collections. Only
+// the owner of the marble can add it.
+// ============================================================================
+func (t *SimpleChaincode) addToCollection(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0            1
+	// "favourites", "marble1"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	owner, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	collection, err := getCollection(stub, owner, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleToAdd, err := getMarble(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertSubmitter(stub, marbleToAdd.OwnerIdentity)
+	if err != nil {
+		return shim.Error("Only the owner of marble " + marbleToAdd.Name + " can add it to a collection: " + err.Error())
+	}
+	if marbleToAdd.OwnerIdentity != collection.OwnerIdentity {
+		return shim.Error("Marbles can only be added to collections of their owner")
+	}
+
+	attributes := collectionAttributes(collection.OwnerIdentity, collection.Name)
+	err = putIndexEntry(stub, "collection~name", append(attributes, marbleToAdd.Name))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putIndexEntry(stub, "name~collection", append([]string{marbleToAdd.Name}, attributes...))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// ============================================================================
+// removeFromCollection - take a marble out of a collection. Collections only
+// hold marbles of their owner, so the collection is looked up among those of
+// the marble's owner, who is the only one that can remove it.
+// ============================================================================
+func (t *SimpleChaincode) removeFromCollection(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0            1
+	// "favourites", "marble1"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	marbleToRemove, err := getMarble(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	collection, err := getCollection(stub, marbleToRemove.OwnerIdentity, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertSubmitter(stub, collection.OwnerIdentity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	memberKey, err := stub.CreateCompositeKey("collection~name", append(collectionAttributes(collection.OwnerIdentity, collection.Name), marbleToRemove.Name))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	member, err := stub.GetState(memberKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if member == nil {
+		return shim.Error(fmt.Sprintf("Marble %s is not in collection %s", marbleToRemove.Name, collection.Name))
+	}
+
+	err = removeFromCollection(stub, collection.OwnerIdentity, collection.Name, marbleToRemove.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// ============================================================================
+// queryCollection - list the marbles of a collection of the submitter, or of
+// the owner passed as MSP ID and ID
+// ============================================================================
+func (t *SimpleChaincode) queryCollection(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0              1                  2
+	// "favourites", "Org1MSP", "<tom's certificate ID>"
+	if len(args) != 1 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 3")
+	}
+
+	var owner marbleIdentity
+	var err error
+	if len(args) == 3 {
+		owner = marbleIdentity{MSPID: args[1], ID: args[2]}
+	} else {
+		owner, err = getSubmitter(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	collection, err := getCollection(stub, owner, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryResults, err := getQueryResultForIndex(stub, "collection~name", collectionAttributes(collection.OwnerIdentity, collection.Name))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// collectionAttributes returns the composite key attributes of a collection, which are
+// also the leading attributes of its collection~name index entries
+func collectionAttributes(owner marbleIdentity, collectionName string) []string {
+	return []string{owner.MSPID, owner.ID, collectionName}
+}
+
+func getCollection(stub shim.ChaincodeStubInterface, owner marbleIdentity, collectionName string) (*marbleCollection, error) {
+	key, err := stub.CreateCompositeKey("marbleCollection", collectionAttributes(owner, collectionName))
+	if err != nil {
+		return nil, err
+	}
+	collectionAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get collection:%s", err.Error())
+	} else if collectionAsBytes == nil {
+		return nil, fmt.Errorf("Collection does not exist: %s", collectionName)
+	}
+
+	collection := &marbleCollection{}
+	err = json.Unmarshal(collectionAsBytes, collection)
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func removeFromCollection(stub shim.ChaincodeStubInterface, owner marbleIdentity, collectionName string, marbleName string) error {
+	attributes := collectionAttributes(owner, collectionName)
+	err := delIndexEntry(stub, "collection~name", append(attributes, marbleName))
+	if err != nil {
+		return err
+	}
+	return delIndexEntry(stub, "name~collection", append([]string{marbleName}, attributes...))
+}
+
+// removeFromAllCollections takes a marble out of every collection it is in. It is called
+// whenever a marble changes owner or is deleted.
+func removeFromAllCollections(stub shim.ChaincodeStubInterface, marbleName string) error {
+	collectionsIterator, err := stub.GetStateByPartialCompositeKey("name~collection", []string{marbleName})
+	if err != nil {
+		return err
+	}
+	defer collectionsIterator.Close()
+
+	for collectionsIterator.HasNext() {
+		responseRange, err := collectionsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return err
+		}
+		// name~collection is marble name, owner MSP ID, owner ID, collection name
+		owner := marbleIdentity{MSPID: compositeKeyParts[1], ID: compositeKeyParts[2]}
+		err = removeFromCollection(stub, owner, compositeKeyParts[3], marbleName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Game rules =========================================================================
+// The rules of the game are kept on the ledger as a marbleConfig, so that they can change
+// without deploying new chaincode. Init stores the config passed to it when the chaincode
+// is instantiated or upgraded, an upgrade without a config keeps the current one.
+// Admins can replace the config with updateConfig.
+//   - allowedColors and the size bounds apply to marbles minted by initMarble and
+//     initMarbles, and to changes made by updateMarble
+//   - maxMarblesPerOwner applies to the owning identity a marble is minted for or
+//     transferred to, by transferMarble, the color transfers, escrow releases and auctions.
+//     Owner names are free-form and are not counted. Trades swap one marble for another,
+//     so they do not change what either identity holds.
+// Marbles that break a rule made stricter after they were minted are left alone.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleConfig holds the rules of the game. Unset fields do not limit anything.
+type marbleConfig struct {
+	MaxMarblesPerOwner int      `json:"maxMarblesPerOwner,omitempty"`
+	AllowedColors      []string `json:"allowedColors,omitempty"`
+	MinSize            *int     `json:"minSize,omitempty"`
+	MaxSize            *int     `json:"maxSize,omitempty"`
+}
+
+// ============================================================================
+// updateConfig - replace the rules of the game, admins only
+// ============================================================================
+func (t *SimpleChaincode) updateConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//                        0
+	// "{\"maxMarblesPerOwner\":10,\"allowedColors\":[\"blue\",\"red\"]}"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if !isMarblesAdmin(stub) {
+		return shim.Error("Only admins can update the config")
+	}
+
+	config, err := parseMarbleConfig(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configJSONasBytes, err := putConfig(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end updateConfig " + string(configJSONasBytes))
+	return shim.Success(configJSONasBytes)
+}
+
+// ============================================================================
+// readConfig - read the rules of the game
+// ============================================================================
+func (t *SimpleChaincode) readConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(configJSONasBytes)
+}
+
+// parseMarbleConfig decodes and checks a config. Unknown fields are rejected, so that a
+// misspelled rule is not silently ignored.
+func parseMarbleConfig(configString string) (*marbleConfig, error) {
+	config := &marbleConfig{}
+	decoder := json.NewDecoder(strings.NewReader(configString))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode config: %s", err.Error())
+	}
+
+	if config.MaxMarblesPerOwner < 0 {
+		return nil, fmt.Errorf("maxMarblesPerOwner must not be negative")
+	}
+	for i, color := range config.AllowedColors {
+		if len(color) <= 0 {
+			return nil, fmt.Errorf("allowedColors must hold non-empty strings")
+		}
+		config.AllowedColors[i] = strings.ToLower(color)
+	}
+	if config.MinSize != nil && config.MaxSize != nil && *config.MinSize > *config.MaxSize {
+		return nil, fmt.Errorf("minSize must not be above maxSize")
+	}
+	return config, nil
+}
+
+// the config lives under a composite key so that it stays out of marble range queries
+func configKey(stub shim.ChaincodeStubInterface) (string, error) {
+	return stub.CreateCompositeKey("marbleConfig", []string{})
+}
+
+// getConfig returns the stored config, or a config without rules if none was stored
+func getConfig(stub shim.ChaincodeStubInterface) (*marbleConfig, error) {
+	key, err := configKey(stub)
+	if err != nil {
+		return nil, err
+	}
+	configAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get config:%s", err.Error())
+	}
+
+	config := &marbleConfig{}
+	if configAsBytes != nil {
+		err = json.Unmarshal(configAsBytes, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func putConfig(stub shim.ChaincodeStubInterface, config *marbleConfig) ([]byte, error) {
+	key, err := configKey(stub)
+	if err != nil {
+		return nil, err
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, configJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return configJSONasBytes, nil
+}
+
+// checkMarble fails if the color or size of a marble breaks the rules
+func (config *marbleConfig) checkMarble(color string, size int) error {
+	if len(config.AllowedColors) > 0 {
+		allowed := false
+		for _, allowedColor := range config.AllowedColors {
+			if color == allowedColor {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Color %s is not allowed, allowed colors are %s", color, strings.Join(config.AllowedColors, ", "))
+		}
+	}
+	if config.MinSize != nil && size < *config.MinSize {
+		return fmt.Errorf("Size %d is below the minimum size of %d", size, *config.MinSize)
+	}
+	if config.MaxSize != nil && size > *config.MaxSize {
+		return fmt.Errorf("Size %d is above the maximum size of %d", size, *config.MaxSize)
+	}
+	return nil
+}
+
+// marbleQuota counts the marbles of owning identities against maxMarblesPerOwner. Owner
+// names are free-form, so the quota is kept per identity rather than per name. Counts
+// read from the identity~name index are cached here together with the marbles added by
+// the transaction, since the index entries it writes cannot be read back before it commits.
+type marbleQuota struct {
+	config *marbleConfig
+	owned  map[marbleIdentity]int
+}
+
+func newMarbleQuota(config *marbleConfig) *marbleQuota {
+	return &marbleQuota{config: config, owned: map[marbleIdentity]int{}}
+}
+
+// add counts n more marbles for owner, failing if that takes the owner over the quota
+func (quota *marbleQuota) add(stub shim.ChaincodeStubInterface, owner marbleIdentity, n int) error {
+	if quota.config.MaxMarblesPerOwner == 0 {
+		return nil
+	}
+	owned, ok := quota.owned[owner]
+	if !ok {
+		var err error
+		owned, err = countMarblesOfOwner(stub, owner)
+		if err != nil {
+			return err
+		}
+	}
+	if owned+n > quota.config.MaxMarblesPerOwner {
+		return fmt.Errorf("Owner %s of %s has %d marbles, the maximum is %d", owner.ID, owner.MSPID, owned, quota.config.MaxMarblesPerOwner)
+	}
+	quota.owned[owner] = owned + n
+	return nil
+}
+
+// remove takes back marbles counted by add, for marbles that were not given to owner after all
+func (quota *marbleQuota) remove(owner marbleIdentity, n int) {
+	if _, ok := quota.owned[owner]; ok {
+		quota.owned[owner] -= n
+	}
+}
+
+// assertOwnerQuota fails if owner cannot be given n more marbles
+func assertOwnerQuota(stub shim.ChaincodeStubInterface, owner marbleIdentity, n int) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	return newMarbleQuota(config).add(stub, owner, n)
+}
+
+func countMarblesOfOwner(stub shim.ChaincodeStubInterface, owner marbleIdentity) (int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("identity~name", []string{owner.MSPID, owner.ID})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		_, err = resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// configFromInitArgs returns the config passed to Init, or nil if none was passed
+func configFromInitArgs(args []string) (*marbleConfig, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 0 || len(strings.TrimSpace(args[0])) == 0 {
+		return nil, nil
+	}
+	return parseMarbleConfig(args[0])
+}
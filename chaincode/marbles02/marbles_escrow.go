@@ -0,0 +1,297 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble escrow ======================================================================
+// An owner can lock a marble for a counterparty while an off-chain payment clears:
+//   escrowMarble  - the owner locks the marble for the counterparty until it expires
+//   releaseEscrow - the owner confirms payment and the marble goes to the counterparty
+//   cancelEscrow  - the counterparty backs out, or the owner takes the marble back once
+//                   the escrow has expired
+// While a marble is locked it cannot be transferred, traded, updated, sold at auction or
+// deleted, and a marble that is up for auction cannot be put in escrow.
+// There is at most one escrow per marble, stored under a marbleEscrow composite key and
+// removed when the escrow is released or cancelled.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleEscrow struct {
+	ObjectType           string         `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	ID                   string         `json:"id"`
+	Marble               string         `json:"marble"`
+	OwnerIdentity        marbleIdentity `json:"ownerIdentity"`
+	Counterparty         string         `json:"counterparty"`
+	CounterpartyIdentity marbleIdentity `json:"counterpartyIdentity"`
+	Expires              int64          `json:"expires"` //unix seconds, compared with the transaction timestamp
+}
+
+// ============================================================================
+// escrowMarble - lock a marble for a counterparty until it expires
+// ============================================================================
+func (t *SimpleChaincode) escrowMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0          1          2                3                     4
+	// "marble1", "jerry", "Org1MSP", "jerry's certificate ID", "3600"
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	counterpartyIdentity, err := parseMarbleIdentity(args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ttl, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || ttl <= 0 {
+		return shim.Error("5th argument must be a positive numeric string")
+	}
+
+	marbleToLock, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleOwner(stub, marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if counterpartyIdentity == marbleToLock.OwnerIdentity {
+		return shim.Error("A marble cannot be held in escrow for its own owner")
+	}
+	err = assertMarbleNotEscrowed(stub, marbleToLock.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, marbleToLock.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	escrow := &marbleEscrow{
+		ObjectType:           "marbleEscrow",
+		ID:                   stub.GetTxID(),
+		Marble:               marbleToLock.Name,
+		OwnerIdentity:        marbleToLock.OwnerIdentity,
+		Counterparty:         strings.ToLower(args[1]),
+		CounterpartyIdentity: counterpartyIdentity,
+		Expires:              txTime.Unix() + ttl,
+	}
+	key, err := stub.CreateCompositeKey("marbleEscrow", []string{escrow.Marble})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	escrowJSONasBytes, err := json.Marshal(escrow)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(key, escrowJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end escrowMarble " + escrow.Marble)
+	return shim.Success(escrowJSONasBytes)
+}
+
+// ============================================================================
+// releaseEscrow - transfer an escrowed marble to the counterparty. Only the
+// owner can release, and only before the escrow expires.
+// ============================================================================
+func (t *SimpleChaincode) releaseEscrow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertSubmitter(stub, escrow.OwnerIdentity)
+	if err != nil {
+		return shim.Error("Only the owner can release an escrow: " + err.Error())
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if txTime.Unix() > escrow.Expires {
+		return shim.Error("Escrow of " + escrow.Marble + " expired at " + time.Unix(escrow.Expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	marbleToRelease, err := getMarble(stub, escrow.Marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToRelease.OwnerIdentity != escrow.OwnerIdentity {
+		return shim.Error("Marble " + escrow.Marble + " has changed owner since it was put in escrow")
+	}
+	if marbleToRelease.OwnerIdentity != escrow.CounterpartyIdentity {
+		err = assertOwnerQuota(stub, escrow.CounterpartyIdentity, 1)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	_, err = changeMarbleOwner(stub, marbleToRelease, escrow.Counterparty, escrow.CounterpartyIdentity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delEscrow(stub, escrow.Marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end releaseEscrow " + escrow.Marble)
+	return shim.Success(nil)
+}
+
+// ============================================================================
+// cancelEscrow - unlock an escrowed marble without transferring it. The
+// counterparty can cancel at any time, the owner only once the escrow expired.
+// ============================================================================
+func (t *SimpleChaincode) cancelEscrow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	allowed := []marbleIdentity{escrow.CounterpartyIdentity}
+	if txTime.Unix() > escrow.Expires {
+		allowed = append(allowed, escrow.OwnerIdentity)
+	}
+	err = assertSubmitter(stub, allowed...)
+	if err != nil {
+		return shim.Error("Only the counterparty can cancel an escrow before it expires: " + err.Error())
+	}
+
+	err = delEscrow(stub, escrow.Marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end cancelEscrow " + escrow.Marble)
+	return shim.Success(nil)
+}
+
+// ============================================================================
+// readEscrow - read the escrow of a marble
+// ============================================================================
+func (t *SimpleChaincode) readEscrow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	escrowJSONasBytes, err := json.Marshal(escrow)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(escrowJSONasBytes)
+}
+
+func getEscrow(stub shim.ChaincodeStubInterface, marbleName string) (*marbleEscrow, error) {
+	key, err := stub.CreateCompositeKey("marbleEscrow", []string{marbleName})
+	if err != nil {
+		return nil, err
+	}
+	escrowAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get escrow:%s", err.Error())
+	} else if escrowAsBytes == nil {
+		return nil, fmt.Errorf("Marble is not held in escrow: %s", marbleName)
+	}
+
+	escrow := &marbleEscrow{}
+	err = json.Unmarshal(escrowAsBytes, escrow)
+	if err != nil {
+		return nil, err
+	}
+	return escrow, nil
+}
+
+func delEscrow(stub shim.ChaincodeStubInterface, marbleName string) error {
+	key, err := stub.CreateCompositeKey("marbleEscrow", []string{marbleName})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// assertMarbleNotEscrowed fails if a marble is locked by an escrow that has not expired.
+// An expired escrow no longer locks the marble, even before it is cancelled.
+func assertMarbleNotEscrowed(stub shim.ChaincodeStubInterface, marbleName string) error {
+	key, err := stub.CreateCompositeKey("marbleEscrow", []string{marbleName})
+	if err != nil {
+		return err
+	}
+	escrowAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get escrow:%s", err.Error())
+	} else if escrowAsBytes == nil {
+		return nil
+	}
+
+	escrow := &marbleEscrow{}
+	err = json.Unmarshal(escrowAsBytes, escrow)
+	if err != nil {
+		return err
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if txTime.Unix() <= escrow.Expires {
+		return fmt.Errorf("Marble %s is held in escrow for %s until %s", marbleName, escrow.Counterparty, time.Unix(escrow.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
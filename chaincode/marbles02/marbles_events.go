@@ -0,0 +1,77 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble events ======================================================================
+// Every change to a marble emits a chaincode event, so that off-chain services such as a
+// search index can mirror the marbles without polling the ledger:
+//   marbleCreated      - payload is the new marble
+//   marblesCreated     - payload is the array of marbles created by initMarbles
+//   marbleUpdated      - payload is the updated marble
+//   marbleDeleted      - payload is the marble as it was before it was deleted
+//   marbleBurned       - payload is the tombstone of the marble
+//   marbleTransferred  - payload is a marbleTransfer
+//   marblesTransferred - payload is a marbleBatchTransfer, for transactions that transfer
+//                        several marbles: transferMarblesBasedOnColor, its batched variant
+//                        and acceptTrade
+// Fabric keeps only one event per transaction, the last one set, so transactions that
+// change several marbles must end with a batch event covering all of them.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	marbleCreatedEvent      = "marbleCreated"
+	marblesCreatedEvent     = "marblesCreated"
+	marbleUpdatedEvent      = "marbleUpdated"
+	marbleDeletedEvent      = "marbleDeleted"
+	marbleBurnedEvent       = "marbleBurned"
+	marbleTransferredEvent  = "marbleTransferred"
+	marblesTransferredEvent = "marblesTransferred"
+)
+
+// marbleTransfer describes one change of owner
+type marbleTransfer struct {
+	Name             string         `json:"name"`
+	OldOwner         string         `json:"oldOwner"`
+	OldOwnerIdentity marbleIdentity `json:"oldOwnerIdentity"`
+	NewOwner         string         `json:"newOwner"`
+	NewOwnerIdentity marbleIdentity `json:"newOwnerIdentity"`
+}
+
+// marbleBatchTransfer describes all changes of owner in a transaction. Color is set for
+// color transfers.
+type marbleBatchTransfer struct {
+	Color     string           `json:"color,omitempty"`
+	Transfers []marbleTransfer `json:"transfers"`
+}
+
+// setMarbleEvent sets the event of the transaction, replacing any event set before
+func setMarbleEvent(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	payloadJSONasBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, payloadJSONasBytes)
+}
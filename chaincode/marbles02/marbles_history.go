@@ -0,0 +1,230 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble history =====================================================================
+// readMarbleAsOf and ownershipTimeline are built on GetHistoryForKey, which requires
+// history to be enabled on the peer (ledger.history.enableHistoryDatabase). Fabric 1.x
+// returns the history of a key oldest first, in the order transactions were committed.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleHistoryRecord is one committed write to a marble. Value holds the bytes as they
+// were written, since older writes may not have every field of the current marble struct;
+// it is only decoded where a field is needed. Value is nil for deletes.
+type marbleHistoryRecord struct {
+	TxID      string
+	Timestamp time.Time
+	IsDelete  bool
+	Value     json.RawMessage
+}
+
+// marble decodes the marble written by the record
+func (record *marbleHistoryRecord) marble() (*marble, error) {
+	m := &marble{}
+	err := json.Unmarshal(record.Value, m)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode marble written by %s: %s", record.TxID, err.Error())
+	}
+	return m, nil
+}
+
+// marbleHistoryEntry is one write in the response of getHistoryForMarble. It keeps the
+// capitalized keys getHistoryForMarble has always returned, TxId included; the responses
+// added since then, such as ownershipTimeline and the burn tombstone, spell it txId.
+type marbleHistoryEntry struct {
+	TxID      string          `json:"TxId"`
+	Value     json.RawMessage `json:"Value"`
+	Timestamp string          `json:"Timestamp"`
+	IsDelete  bool            `json:"IsDelete"`
+	Submitter *marbleIdentity `json:"Submitter,omitempty"`
+}
+
+// ownershipInterval is a period during which a marble had the same owner. To is empty
+// while the owner still holds the marble. Burned is set on the last interval of a marble
+// that was burned, which ends at the burn.
+type ownershipInterval struct {
+	Owner         string         `json:"owner"`
+	OwnerIdentity marbleIdentity `json:"ownerIdentity"`
+	From          string         `json:"from"`
+	To            string         `json:"to,omitempty"`
+	TxID          string         `json:"txId"`
+	Burned        bool           `json:"burned,omitempty"`
+}
+
+// ===========================================================================================
+// readMarbleAsOf returns a marble as it was at a point in time, given either as an RFC3339
+// timestamp or as a transaction ID. For a transaction ID the marble is returned as that
+// transaction left it. The marble is returned exactly as it was written. If the marble had
+// been burned by then, only its tombstone existed and the burn is reported instead.
+// ===========================================================================================
+func (t *SimpleChaincode) readMarbleAsOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0                 1
+	// "marble1", "2018-06-01T10:00:00Z" or "txId"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	marbleName := args[0]
+	history, err := getMarbleHistory(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var found *marbleHistoryRecord
+	asOf, err := time.Parse(time.RFC3339Nano, args[1])
+	if err == nil {
+		// the last write at or before the timestamp
+		for i := range history {
+			if history[i].Timestamp.After(asOf) {
+				break
+			}
+			found = &history[i]
+		}
+	} else {
+		for i := range history {
+			if history[i].TxID == args[1] {
+				found = &history[i]
+				break
+			}
+		}
+		if found == nil {
+			return shim.Error(fmt.Sprintf("Transaction %s did not write marble %s", args[1], marbleName))
+		}
+	}
+	if found == nil || found.IsDelete {
+		return shim.Error(fmt.Sprintf("Marble %s did not exist as of %s", marbleName, args[1]))
+	}
+
+	// only the tombstone is decoded, the marble is returned as it was written
+	var written struct {
+		Burned *marbleBurn `json:"burned"`
+	}
+	err = json.Unmarshal(found.Value, &written)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to decode marble written by %s: %s", found.TxID, err.Error()))
+	}
+	if written.Burned != nil {
+		return shim.Error(fmt.Sprintf("Marble %s was burned as of %s, by transaction %s at %s", marbleName, args[1], written.Burned.TxID, written.Burned.BurnedAt))
+	}
+
+	return shim.Success(found.Value)
+}
+
+// ===========================================================================================
+// ownershipTimeline condenses the history of a marble into the periods it was held by each
+// owner. Updates that do not change the owner are folded into the current period, and a
+// delete ends it. A burn ends the timeline, as a burned marble is never held again.
+// ===========================================================================================
+func (t *SimpleChaincode) ownershipTimeline(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	history, err := getMarbleHistory(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	timeline := []ownershipInterval{}
+	var current *ownershipInterval
+	for _, record := range history {
+		var written *marble
+		if !record.IsDelete {
+			written, err = record.marble()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		if written != nil && written.Burned != nil {
+			if current != nil {
+				current.To = record.Timestamp.Format(time.RFC3339Nano)
+				current.Burned = true
+				timeline = append(timeline, *current)
+				current = nil
+			}
+			break
+		}
+		if current != nil && written != nil && written.Owner == current.Owner && written.OwnerIdentity == current.OwnerIdentity {
+			continue
+		}
+		if current != nil {
+			current.To = record.Timestamp.Format(time.RFC3339Nano)
+			timeline = append(timeline, *current)
+			current = nil
+		}
+		if written != nil {
+			current = &ownershipInterval{
+				Owner:         written.Owner,
+				OwnerIdentity: written.OwnerIdentity,
+				From:          record.Timestamp.Format(time.RFC3339Nano),
+				TxID:          record.TxID,
+			}
+		}
+	}
+	if current != nil {
+		timeline = append(timeline, *current)
+	}
+
+	timelineJSONasBytes, err := json.Marshal(timeline)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(timelineJSONasBytes)
+}
+
+// getMarbleHistory reads the full history of a marble, oldest first
+func getMarbleHistory(stub shim.ChaincodeStubInterface, marbleName string) ([]marbleHistoryRecord, error) {
+	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var history []marbleHistoryRecord
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		record := marbleHistoryRecord{TxID: response.TxId, IsDelete: response.IsDelete}
+		if response.Timestamp != nil {
+			record.Timestamp = time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC()
+		}
+		if !response.IsDelete {
+			record.Value = response.Value
+		}
+		history = append(history, record)
+	}
+	return history, nil
+}
@@ -0,0 +1,199 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Bulk minting =======================================================================
+// initMarbles creates many marbles in one transaction from a JSON array of marble specs,
+// e.g. to seed a game season. Each spec is checked the way initMarble checks its
+// arguments, and also against the specs before it in the same array, since marbles
+// written by the transaction cannot be read back before it commits. Specs that fail are
+// reported in the response and do not stop the others from being created.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxInitMarbles caps the number of specs in an initMarbles call, to keep the write set
+// of the transaction to a reasonable size
+const maxInitMarbles = 1000
+
+// marbleSpec is one entry of the initMarbles array. Size may be a number or, as in
+// initMarble, a numeric string.
+type marbleSpec struct {
+	Name  string          `json:"name"`
+	Color string          `json:"color"`
+	Size  json.RawMessage `json:"size"`
+	Owner string          `json:"owner"`
+}
+
+// initMarblesResult is the outcome of one spec, in the order of the initMarbles array
+type initMarblesResult struct {
+	Name    string `json:"name"`
+	Created bool   `json:"created"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ============================================================================
+// initMarbles - create a marble for each spec of a JSON array
+// ============================================================================
+func (t *SimpleChaincode) initMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//                                   0
+	// "[{"name":"marble4","color":"red","size":20,"owner":"tom"}, ...]"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start initMarbles")
+	var items []json.RawMessage
+	err := json.Unmarshal([]byte(args[0]), &items)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of marble specs: " + err.Error())
+	}
+	if len(items) == 0 {
+		return shim.Error("1st argument must hold at least one marble spec")
+	}
+	if len(items) > maxInitMarbles {
+		return shim.Error(fmt.Sprintf("at most %d marbles can be created at once", maxInitMarbles))
+	}
+
+	// ==== The submitter becomes the creator and owning identity of every marble ====
+	creator, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quota := newMarbleQuota(config)
+
+	results := []initMarblesResult{}
+	created := []*marble{}
+	seen := map[string]bool{}
+	editions := newMarbleEditions()
+	for i, item := range items {
+		var spec marbleSpec
+		err = json.Unmarshal(item, &spec)
+		if err != nil {
+			results = append(results, initMarblesResult{Error: fmt.Sprintf("spec %d is not a marble spec: %s", i, err.Error())})
+			continue
+		}
+		result := initMarblesResult{Name: spec.Name}
+
+		marble, err := newMarbleFromSpec(stub, &spec, creator, seen, config)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		err = quota.add(stub, marble.OwnerIdentity, 1)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		seen[marble.Name] = true
+
+		marble.Provenance, err = mintProvenance(stub, marble.Color, editions)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = putNewMarble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Created = true
+		results = append(results, result)
+		created = append(created, marble)
+	}
+
+	err = editions.put(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = setMarbleEvent(stub, marblesCreatedEvent, created)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsJSONasBytes, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- end initMarbles: created %d of %d\n", len(created), len(items))
+	return shim.Success(resultsJSONasBytes)
+}
+
+// newMarbleFromSpec checks a spec against the rules of the game and returns the marble to
+// create for it. seen holds the names created earlier in the same transaction.
+func newMarbleFromSpec(stub shim.ChaincodeStubInterface, spec *marbleSpec, creator marbleIdentity, seen map[string]bool, config *marbleConfig) (*marble, error) {
+	if len(spec.Name) <= 0 {
+		return nil, fmt.Errorf("name must be a non-empty string")
+	}
+	if len(spec.Color) <= 0 {
+		return nil, fmt.Errorf("color must be a non-empty string")
+	}
+	if len(spec.Size) <= 0 || string(spec.Size) == "null" {
+		return nil, fmt.Errorf("size must be set")
+	}
+	if len(spec.Owner) <= 0 {
+		return nil, fmt.Errorf("owner must be a non-empty string")
+	}
+	size, err := strconv.Atoi(strings.Trim(string(spec.Size), `"`))
+	if err != nil {
+		return nil, fmt.Errorf("size must be an integer")
+	}
+	color := strings.ToLower(spec.Color)
+	err = config.checkMarble(color, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if seen[spec.Name] {
+		return nil, fmt.Errorf("This marble is already created by this transaction: %s", spec.Name)
+	}
+	err = assertMarbleNameFree(stub, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &marble{
+		ObjectType:    "marble",
+		Name:          spec.Name,
+		Color:         color,
+		Size:          size,
+		Owner:         strings.ToLower(spec.Owner),
+		Creator:       creator,
+		OwnerIdentity: creator,
+		Version:       1,
+		ModifiedBy:    &creator,
+	}, nil
+}
@@ -0,0 +1,272 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Private marble details =============================================================
+// A marble can carry a private price and appraisal, kept in a private data collection of
+// the owner's org (see collections_config.json) so that other orgs only see its hash.
+// The details are passed in the transient map under "marble_details":
+//   {"price":99,"appraisal":120,"salt":"a long random string"}
+// The price is also stored on its own, with the salt, so that a buyer who was told the
+// price and salt by the seller can check them with verifyMarblePrice against the private
+// data hash on their own peer, without seeing the appraisal or any other org's data.
+// Details are bound to the owning identity, and are ignored once the marble changes hands.
+// =========================================================================================
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// minPriceSaltLength keeps private prices from being brute forced from their hash
+const minPriceSaltLength = 16
+
+type marblePrivateDetails struct {
+	ObjectType    string         `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name          string         `json:"name"`
+	OwnerIdentity marbleIdentity `json:"ownerIdentity"`
+	Price         int            `json:"price"`
+	Appraisal     int            `json:"appraisal"`
+}
+
+// marblePrice is stored next to the private details. Its JSON encoding must not change,
+// as verifyMarblePrice rebuilds it to compare hashes.
+type marblePrice struct {
+	Name          string         `json:"name"`
+	OwnerIdentity marbleIdentity `json:"ownerIdentity"`
+	Price         int            `json:"price"`
+	Salt          string         `json:"salt"`
+}
+
+type verifyMarblePriceResult struct {
+	Name     string `json:"name"`
+	Price    int    `json:"price"`
+	Verified bool   `json:"verified"`
+}
+
+// privateDetailsCollection is the private data collection of an org
+func privateDetailsCollection(mspID string) string {
+	return "collectionMarblePrivateDetails" + mspID
+}
+
+// ============================================================================
+// setMarblePrivateDetails - set the private price and appraisal of a marble
+// ============================================================================
+func (t *SimpleChaincode) setMarblePrivateDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1. Private details must be passed in transient map.")
+	}
+
+	marbleToPrice, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleOwner(stub, marbleToPrice)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+	detailsJSON, ok := transMap["marble_details"]
+	if !ok {
+		return shim.Error("marble_details must be a key in the transient map")
+	}
+	var detailsInput struct {
+		Price     int    `json:"price"`
+		Appraisal int    `json:"appraisal"`
+		Salt      string `json:"salt"`
+	}
+	err = json.Unmarshal(detailsJSON, &detailsInput)
+	if err != nil {
+		return shim.Error("Failed to decode JSON of marble_details: " + err.Error())
+	}
+	if detailsInput.Price <= 0 {
+		return shim.Error("price field must be a positive integer")
+	}
+	if detailsInput.Appraisal < 0 {
+		return shim.Error("appraisal field must be a non-negative integer")
+	}
+	if len(detailsInput.Salt) < minPriceSaltLength {
+		return shim.Error(fmt.Sprintf("salt field must be at least %d characters", minPriceSaltLength))
+	}
+
+	collection := privateDetailsCollection(marbleToPrice.OwnerIdentity.MSPID)
+	details := &marblePrivateDetails{
+		ObjectType:    "marblePrivateDetails",
+		Name:          marbleToPrice.Name,
+		OwnerIdentity: marbleToPrice.OwnerIdentity,
+		Price:         detailsInput.Price,
+		Appraisal:     detailsInput.Appraisal,
+	}
+	detailsJSONasBytes, err := json.Marshal(details)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutPrivateData(collection, marbleToPrice.Name, detailsJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	price := &marblePrice{
+		Name:          marbleToPrice.Name,
+		OwnerIdentity: marbleToPrice.OwnerIdentity,
+		Price:         detailsInput.Price,
+		Salt:          detailsInput.Salt,
+	}
+	priceJSONasBytes, err := json.Marshal(price)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	priceKey, err := stub.CreateCompositeKey("marblePrice", []string{marbleToPrice.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutPrivateData(collection, priceKey, priceJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================
+// readMarblePrivateDetails - read the private details of a marble. Only members
+// of the owner's org can read them.
+// ============================================================================
+func (t *SimpleChaincode) readMarblePrivateDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleToRead, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitter, err := getSubmitter(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if submitter.MSPID != marbleToRead.OwnerIdentity.MSPID {
+		return shim.Error("Only members of " + marbleToRead.OwnerIdentity.MSPID + " can read the private details of marble " + marbleToRead.Name)
+	}
+
+	detailsAsBytes, err := stub.GetPrivateData(privateDetailsCollection(marbleToRead.OwnerIdentity.MSPID), marbleToRead.Name)
+	if err != nil {
+		return shim.Error("Failed to get private details for " + marbleToRead.Name + ": " + err.Error())
+	} else if detailsAsBytes == nil {
+		return shim.Error("Marble private details do not exist: " + marbleToRead.Name)
+	}
+
+	details := &marblePrivateDetails{}
+	err = json.Unmarshal(detailsAsBytes, details)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// details set by a previous owner in the same org
+	if details.OwnerIdentity != marbleToRead.OwnerIdentity {
+		return shim.Error("Marble private details do not exist: " + marbleToRead.Name)
+	}
+	return shim.Success(detailsAsBytes)
+}
+
+// ============================================================================
+// verifyMarblePrice - check a price and salt given by the seller against the
+// hash of the private price of a marble. Any org can verify, since only the
+// hash of the private data is read.
+// ============================================================================
+func (t *SimpleChaincode) verifyMarblePrice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1. Price must be passed in transient map.")
+	}
+
+	marbleToVerify, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+	priceJSON, ok := transMap["marble_price"]
+	if !ok {
+		return shim.Error("marble_price must be a key in the transient map")
+	}
+	var priceInput struct {
+		Price int    `json:"price"`
+		Salt  string `json:"salt"`
+	}
+	err = json.Unmarshal(priceJSON, &priceInput)
+	if err != nil {
+		return shim.Error("Failed to decode JSON of marble_price: " + err.Error())
+	}
+
+	price := &marblePrice{
+		Name:          marbleToVerify.Name,
+		OwnerIdentity: marbleToVerify.OwnerIdentity,
+		Price:         priceInput.Price,
+		Salt:          priceInput.Salt,
+	}
+	priceJSONasBytes, err := json.Marshal(price)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	expectedHash := sha256.Sum256(priceJSONasBytes)
+
+	priceKey, err := stub.CreateCompositeKey("marblePrice", []string{marbleToVerify.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	storedHash, err := stub.GetPrivateDataHash(privateDetailsCollection(marbleToVerify.OwnerIdentity.MSPID), priceKey)
+	if err != nil {
+		return shim.Error("Failed to get private price hash for " + marbleToVerify.Name + ": " + err.Error())
+	} else if storedHash == nil {
+		return shim.Error("Marble has no private price: " + marbleToVerify.Name)
+	}
+	if !bytes.Equal(storedHash, expectedHash[:]) {
+		return shim.Error("Price does not match the private price of marble " + marbleToVerify.Name)
+	}
+
+	result := &verifyMarblePriceResult{Name: marbleToVerify.Name, Price: priceInput.Price, Verified: true}
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the price itself is private, so only the outcome is logged
+	fmt.Println("- end verifyMarblePrice: price of " + marbleToVerify.Name + " matches")
+	return shim.Success(resultJSONasBytes)
+}
@@ -0,0 +1,236 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble provenance ==================================================================
+// Every marble is stamped with provenance when it is minted by initMarble or initMarbles:
+// the minting transaction, its timestamp and an edition number counting the marbles
+// minted in the same color. The minter is the marble's Creator. Edition numbers are never
+// reused, deleting a marble does not give its number back.
+// verifyProvenance compares the provenance of a marble with the write that minted it, the
+// first entry of its history since it was last deleted. A record whose provenance does not
+// match was not written by this chaincode's minting functions and should be treated as
+// counterfeit.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleProvenance is set when a marble is minted and never changes. Color is the color
+// the marble was minted in, which Edition counts within.
+type marbleProvenance struct {
+	MintTxID      string `json:"mintTxId"`
+	MintTimestamp string `json:"mintTimestamp"`
+	Color         string `json:"color"`
+	Edition       int    `json:"edition"`
+}
+
+// provenanceReport is the response of verifyProvenance
+type provenanceReport struct {
+	Name       string            `json:"name"`
+	Valid      bool              `json:"valid"`
+	Problems   []string          `json:"problems"`
+	Creator    marbleIdentity    `json:"creator"`
+	Provenance *marbleProvenance `json:"provenance"`
+}
+
+// marbleEditions hands out edition numbers. The last edition of each color is kept in
+// state under marbleEdition [color]; counters read in a transaction are cached here, since
+// the counters it writes cannot be read back before it commits.
+type marbleEditions struct {
+	last map[string]int
+}
+
+func newMarbleEditions() *marbleEditions {
+	return &marbleEditions{last: map[string]int{}}
+}
+
+func editionKey(stub shim.ChaincodeStubInterface, color string) (string, error) {
+	return stub.CreateCompositeKey("marbleEdition", []string{color})
+}
+
+func getLastEdition(stub shim.ChaincodeStubInterface, color string) (int, error) {
+	key, err := editionKey(stub, color)
+	if err != nil {
+		return 0, err
+	}
+	editionAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get edition of %s marbles:%s", color, err.Error())
+	} else if editionAsBytes == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(editionAsBytes))
+}
+
+// next returns the next edition number of a color
+func (e *marbleEditions) next(stub shim.ChaincodeStubInterface, color string) (int, error) {
+	last, ok := e.last[color]
+	if !ok {
+		var err error
+		last, err = getLastEdition(stub, color)
+		if err != nil {
+			return 0, err
+		}
+	}
+	e.last[color] = last + 1
+	return last + 1, nil
+}
+
+// put saves the counters of all colors handed out by next
+func (e *marbleEditions) put(stub shim.ChaincodeStubInterface) error {
+	colors := []string{}
+	for color := range e.last {
+		colors = append(colors, color)
+	}
+	sort.Strings(colors)
+	for _, color := range colors {
+		key, err := editionKey(stub, color)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(key, []byte(strconv.Itoa(e.last[color])))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mintProvenance returns the provenance of a marble minted in color by this transaction
+func mintProvenance(stub shim.ChaincodeStubInterface, color string, editions *marbleEditions) (*marbleProvenance, error) {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	edition, err := editions.next(stub, color)
+	if err != nil {
+		return nil, err
+	}
+	return &marbleProvenance{
+		MintTxID:      stub.GetTxID(),
+		MintTimestamp: txTime.Format(time.RFC3339Nano),
+		Color:         color,
+		Edition:       edition,
+	}, nil
+}
+
+// ===========================================================================================
+// verifyProvenance checks the provenance of a marble against the write that minted it.
+// Problems are reported in the response rather than failing the query.
+// ===========================================================================================
+func (t *SimpleChaincode) verifyProvenance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marble, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start verifyProvenance: " + marble.Name)
+
+	report := provenanceReport{Name: marble.Name, Problems: []string{}, Creator: marble.Creator, Provenance: marble.Provenance}
+	if marble.Provenance == nil {
+		report.Problems = append(report.Problems, "marble has no provenance")
+	} else {
+		history, err := getMarbleHistory(stub, marble.Name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		report.Problems, err = checkProvenance(stub, marble, history)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	report.Valid = len(report.Problems) == 0
+
+	reportJSONasBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end verifyProvenance: valid %t\n", report.Valid)
+	return shim.Success(reportJSONasBytes)
+}
+
+// checkProvenance lists the ways in which the provenance of a marble disagrees with its
+// history and the edition counter of its mint color
+func checkProvenance(stub shim.ChaincodeStubInterface, marble *marble, history []marbleHistoryRecord) ([]string, error) {
+	provenance := marble.Provenance
+	problems := []string{}
+
+	// the marble was minted by the first write after its last delete
+	var minted *marbleHistoryRecord
+	for i := range history {
+		if history[i].IsDelete {
+			minted = nil
+		} else if minted == nil {
+			minted = &history[i]
+		}
+	}
+	if minted == nil {
+		return append(problems, "marble has no history"), nil
+	}
+	mintedMarble, err := minted.marble()
+	if err != nil {
+		return nil, err
+	}
+
+	if minted.TxID != provenance.MintTxID {
+		problems = append(problems, fmt.Sprintf("marble was first written by transaction %s, not %s", minted.TxID, provenance.MintTxID))
+	}
+	mintTime, err := time.Parse(time.RFC3339Nano, provenance.MintTimestamp)
+	if err != nil || !mintTime.Equal(minted.Timestamp) {
+		problems = append(problems, fmt.Sprintf("marble was first written at %s, not %s", minted.Timestamp.Format(time.RFC3339Nano), provenance.MintTimestamp))
+	}
+	if mintedMarble.Version != 1 {
+		problems = append(problems, fmt.Sprintf("marble was first written at version %d", mintedMarble.Version))
+	}
+	if mintedMarble.Creator != marble.Creator {
+		problems = append(problems, fmt.Sprintf("marble was minted by %s of %s, not %s of %s", mintedMarble.Creator.ID, mintedMarble.Creator.MSPID, marble.Creator.ID, marble.Creator.MSPID))
+	}
+	if !reflect.DeepEqual(mintedMarble.Provenance, provenance) {
+		problems = append(problems, "provenance has changed since the marble was minted")
+	}
+	if mintedMarble.Color != provenance.Color {
+		problems = append(problems, fmt.Sprintf("marble was minted in %s, not %s", mintedMarble.Color, provenance.Color))
+	}
+
+	lastEdition, err := getLastEdition(stub, provenance.Color)
+	if err != nil {
+		return nil, err
+	}
+	if provenance.Edition < 1 || provenance.Edition > lastEdition {
+		problems = append(problems, fmt.Sprintf("edition %d of %s marbles has not been minted", provenance.Edition, provenance.Color))
+	}
+	return problems, nil
+}
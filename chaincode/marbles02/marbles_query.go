@@ -0,0 +1,317 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Rich query limits ==================================================================
+// queryMarbles and queryMarblesWithPagination do not pass client query strings to the
+// state database as is. Each query is parsed and rewritten by parseMarbleQuery:
+//   - the selector is forced to docType "marble", so other objects cannot be queried
+//   - burned marbles are left out unless the client asks to include them
+//   - only the operators in marbleQueryOperators may be used, and $regex only on
+//     fields of the index used by the query
+//   - use_index must name one of marbleIndexes, the indexes shipped with the chaincode
+//     in META-INF/statedb/couchdb/indexes, and the selector must cover all its fields
+//   - results are capped at maxMarbleQueryResults
+// =========================================================================================
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// maxMarbleQueryResults caps both the results of queryMarbles and the page size of
+// queryMarblesWithPagination
+const maxMarbleQueryResults = 100
+
+// marbleIndex is a CouchDB index shipped in META-INF/statedb/couchdb/indexes
+type marbleIndex struct {
+	DesignDoc string
+	Name      string
+	Fields    []string
+}
+
+var marbleIndexes = []marbleIndex{
+	{DesignDoc: "_design/indexOwnerDoc", Name: "indexOwner", Fields: []string{"docType", "owner"}},
+	{DesignDoc: "_design/indexColorDoc", Name: "indexColor", Fields: []string{"docType", "color"}},
+	{DesignDoc: "_design/indexSizeSortDoc", Name: "indexSizeSortDesc", Fields: []string{"size", "docType", "owner"}},
+}
+
+// marbleQueryFields are the marble fields that may appear in selectors and field lists
+var marbleQueryFields = map[string]bool{"docType": true, "name": true, "color": true, "size": true, "owner": true}
+
+// marbleQueryOperators are the field operators allowed in selectors. $or, $not, $nor and
+// the like are left out since CouchDB cannot answer them from an index.
+var marbleQueryOperators = map[string]bool{"$eq": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$in": true, "$regex": true}
+
+// marbleQuery is a client query string after parseMarbleQuery has checked and rewritten it
+type marbleQuery struct {
+	QueryString string
+	// Limit is the number of results asked for by the client, or 0 if it did not ask
+	Limit int
+}
+
+// parseMarbleQuery checks a client query string against the rich query limits and
+// returns the query string to send to the state database. Paginated queries must not
+// set a limit, the page size takes its place.
+func parseMarbleQuery(queryString string, paginated bool, includeBurned bool) (*marbleQuery, error) {
+	var query map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(queryString))
+	decoder.UseNumber()
+	err := decoder.Decode(&query)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode query string: %s", err.Error())
+	}
+
+	for key := range query {
+		switch key {
+		case "selector", "use_index", "fields", "sort":
+		case "limit":
+			if paginated {
+				return nil, fmt.Errorf("limit is not allowed in paginated queries, use the page size instead")
+			}
+		default:
+			return nil, fmt.Errorf("%s is not allowed in marble queries", key)
+		}
+	}
+
+	index, err := parseUseIndex(query["use_index"])
+	if err != nil {
+		return nil, err
+	}
+	indexFields := map[string]bool{}
+	for _, field := range index.Fields {
+		indexFields[field] = true
+	}
+
+	selector, ok := query["selector"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("query must have a selector object")
+	}
+	selector["docType"] = "marble"
+	selectorFields := map[string]bool{}
+	err = checkMarbleSelector(selector, indexFields, selectorFields)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range index.Fields {
+		if !selectorFields[field] {
+			return nil, fmt.Errorf("selector must include %s to use index %s", field, index.Name)
+		}
+	}
+	if !includeBurned {
+		selector["burned"] = map[string]interface{}{"$exists": false}
+	}
+
+	if fields, ok := query["fields"]; ok {
+		fieldList, ok := fields.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("fields must be an array")
+		}
+		for _, field := range fieldList {
+			name, ok := field.(string)
+			if !ok || !marbleQueryFields[name] {
+				return nil, fmt.Errorf("%v is not a marble field", field)
+			}
+		}
+	}
+
+	if sort, ok := query["sort"]; ok {
+		err = checkMarbleSort(sort, indexFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parsed := &marbleQuery{}
+	if limit, ok := query["limit"]; ok {
+		number, ok := limit.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("limit must be a number")
+		}
+		limit, err := number.Int64()
+		if err != nil || limit <= 0 || limit > maxMarbleQueryResults {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxMarbleQueryResults)
+		}
+		parsed.Limit = int(limit)
+	}
+
+	queryJSONasBytes, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	parsed.QueryString = string(queryJSONasBytes)
+	return parsed, nil
+}
+
+// parseUseIndex finds the shipped index named by use_index, which is either a design doc
+// or a [design doc, index name] pair
+func parseUseIndex(useIndex interface{}) (*marbleIndex, error) {
+	var designDoc, name string
+	switch value := useIndex.(type) {
+	case string:
+		designDoc = value
+	case []interface{}:
+		if len(value) < 1 || len(value) > 2 {
+			return nil, fmt.Errorf("use_index must be a design doc or a [design doc, index name] pair")
+		}
+		for i, part := range value {
+			partString, ok := part.(string)
+			if !ok {
+				return nil, fmt.Errorf("use_index must only hold strings")
+			}
+			if i == 0 {
+				designDoc = partString
+			} else {
+				name = partString
+			}
+		}
+	case nil:
+		return nil, fmt.Errorf("query must name one of the shipped indexes in use_index")
+	default:
+		return nil, fmt.Errorf("use_index must be a design doc or a [design doc, index name] pair")
+	}
+
+	if !strings.HasPrefix(designDoc, "_design/") {
+		designDoc = "_design/" + designDoc
+	}
+	for i := range marbleIndexes {
+		if marbleIndexes[i].DesignDoc == designDoc && (name == "" || marbleIndexes[i].Name == name) {
+			return &marbleIndexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not one of the shipped indexes", useIndex)
+}
+
+// checkMarbleSelector checks the fields and operators of a selector, recording the
+// fields it constrains in selectorFields. $and may combine selectors.
+func checkMarbleSelector(selector map[string]interface{}, indexFields map[string]bool, selectorFields map[string]bool) error {
+	for field, condition := range selector {
+		if field == "$and" {
+			selectors, ok := condition.([]interface{})
+			if !ok {
+				return fmt.Errorf("$and must be an array of selectors")
+			}
+			for _, s := range selectors {
+				subSelector, ok := s.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("$and must be an array of selectors")
+				}
+				err := checkMarbleSelector(subSelector, indexFields, selectorFields)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(field, "$") {
+			return fmt.Errorf("operator %s is not allowed in marble queries", field)
+		}
+		if !marbleQueryFields[field] {
+			return fmt.Errorf("%s is not a marble field", field)
+		}
+		selectorFields[field] = true
+
+		// a plain value is an implicit $eq
+		operators, ok := condition.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for operator := range operators {
+			if !marbleQueryOperators[operator] {
+				return fmt.Errorf("operator %s is not allowed in marble queries", operator)
+			}
+			if operator == "$regex" && !indexFields[field] {
+				return fmt.Errorf("$regex is only allowed on indexed fields, %s is not one", field)
+			}
+		}
+	}
+	return nil
+}
+
+// checkMarbleSort only allows sorting on fields of the index used by the query
+func checkMarbleSort(sort interface{}, indexFields map[string]bool) error {
+	sortList, ok := sort.([]interface{})
+	if !ok {
+		return fmt.Errorf("sort must be an array")
+	}
+	for _, entry := range sortList {
+		switch value := entry.(type) {
+		case string:
+			if !indexFields[value] {
+				return fmt.Errorf("can only sort on indexed fields, %s is not one", value)
+			}
+		case map[string]interface{}:
+			for field := range value {
+				if !indexFields[field] {
+					return fmt.Errorf("can only sort on indexed fields, %s is not one", field)
+				}
+			}
+		default:
+			return fmt.Errorf("sort must be an array of fields")
+		}
+	}
+	return nil
+}
+
+// =========================================================================================
+// getQueryResultForMarbleQuery executes a query checked by parseMarbleQuery. It returns
+// the first query.Limit results, or fails if the query has more than maxMarbleQueryResults
+// results and the client did not set a limit.
+// =========================================================================================
+func getQueryResultForMarbleQuery(stub shim.ChaincodeStubInterface, query *marbleQuery) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForMarbleQuery queryString:\n%s\n", query.QueryString)
+
+	resultsIterator, err := stub.GetQueryResult(query.QueryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON array containing QueryRecords
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	count := 0
+	for resultsIterator.HasNext() {
+		if query.Limit > 0 && count == query.Limit {
+			break
+		}
+		if count == maxMarbleQueryResults {
+			return nil, fmt.Errorf("query has more than %d results, set a limit or use queryMarblesWithPagination", maxMarbleQueryResults)
+		}
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQueryRecord(&buffer, queryResponse.Key, queryResponse.Value, count > 0); err != nil {
+			return nil, err
+		}
+		count++
+	}
+	buffer.WriteString("]")
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,176 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleCount struct {
+	Count     int `json:"count"`
+	TotalSize int `json:"totalSize"`
+}
+
+func (c *marbleCount) add(m *marble) {
+	c.Count++
+	c.TotalSize += m.Size
+}
+
+// marbleStatsPage tells the client where the next page of marbleStats starts. An empty
+// bookmark means the page was the last one.
+type marbleStatsPage struct {
+	RecordsCount int32  `json:"RecordsCount"`
+	Bookmark     string `json:"Bookmark"`
+}
+
+// marbleStatsResult is the response of marbleStats. Partial is true unless the page was
+// both the first and the last, i.e. unless the stats cover every marble that matches.
+type marbleStatsResult struct {
+	Total            marbleCount             `json:"total"`
+	ByOwner          map[string]*marbleCount `json:"byOwner"`
+	ByColor          map[string]*marbleCount `json:"byColor"`
+	Partial          bool                    `json:"partial"`
+	ResponseMetadata marbleStatsPage         `json:"ResponseMetadata"`
+}
+
+// ===========================================================================================
+// marbleStats counts marbles and sums their sizes, in total and grouped by owner and by
+// color. Marbles are found through the color~name index, so a color filter only reads the
+// marbles of that color. Marbles can also be filtered by owner and by size range; empty
+// filter arguments are ignored.
+// Like the rich queries, a call reads at most maxMarbleQueryResults index entries. The
+// stats cover one page of the index and come with the bookmark of the next page, so the
+// stats of all marbles are the sum over the pages, and the response is marked partial
+// whenever there is more than one page. Being paginated, marbleStats can only be
+// evaluated, not submitted.
+// ===========================================================================================
+func (t *SimpleChaincode) marbleStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	//     0        1         2          3            4            5
+	// ["color", "owner", "minSize", "maxSize", "pageSize", "bookmark"]
+	if len(args) > 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 6")
+	}
+
+	var colorFilter, ownerFilter string
+	if len(args) > 0 {
+		colorFilter = strings.ToLower(args[0])
+	}
+	if len(args) > 1 {
+		ownerFilter = strings.ToLower(args[1])
+	}
+	minSize, maxSize := -1, -1
+	if len(args) > 2 && args[2] != "" {
+		minSize, err = strconv.Atoi(args[2])
+		if err != nil {
+			return shim.Error("3rd argument must be a numeric string")
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		maxSize, err = strconv.Atoi(args[3])
+		if err != nil {
+			return shim.Error("4th argument must be a numeric string")
+		}
+	}
+
+	pageSize := int32(maxMarbleQueryResults)
+	if len(args) > 4 && args[4] != "" {
+		pageSize, err = parsePageSize(args[4])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if pageSize > maxMarbleQueryResults {
+			return shim.Error(fmt.Sprintf("page size must be at most %d", maxMarbleQueryResults))
+		}
+	}
+	var bookmark string
+	if len(args) > 5 {
+		bookmark = args[5]
+	}
+
+	var indexAttributes []string
+	if colorFilter != "" {
+		indexAttributes = []string{colorFilter}
+	}
+	resultsIterator, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination("color~name", indexAttributes, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	stats := marbleStatsResult{ByOwner: map[string]*marbleCount{}, ByColor: map[string]*marbleCount{}}
+	if responseMetadata != nil {
+		stats.ResponseMetadata = marbleStatsPage{RecordsCount: responseMetadata.FetchedRecordsCount, Bookmark: responseMetadata.Bookmark}
+	}
+	// pages before this one, or after it, hold marbles these stats do not count
+	stats.Partial = bookmark != "" || stats.ResponseMetadata.Bookmark != ""
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		marbleAsBytes, err := stub.GetState(compositeKeyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if marbleAsBytes == nil {
+			continue
+		}
+		m := &marble{}
+		err = json.Unmarshal(marbleAsBytes, m)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if ownerFilter != "" && m.Owner != ownerFilter {
+			continue
+		}
+		if (minSize >= 0 && m.Size < minSize) || (maxSize >= 0 && m.Size > maxSize) {
+			continue
+		}
+
+		stats.Total.add(m)
+		if stats.ByOwner[m.Owner] == nil {
+			stats.ByOwner[m.Owner] = &marbleCount{}
+		}
+		stats.ByOwner[m.Owner].add(m)
+		if stats.ByColor[m.Color] == nil {
+			stats.ByColor[m.Color] = &marbleCount{}
+		}
+		stats.ByColor[m.Color].add(m)
+	}
+
+	statsJSONasBytes, err := json.Marshal(stats)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statsJSONasBytes)
+}
@@ -0,0 +1,332 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble trades ======================================================================
+// A trade swaps two marbles between their owners in two phases. The owner of the offered
+// marble proposes the swap, optionally with a price to be settled off-chain, and the owner
+// of the requested marble accepts it. Both changes of ownership are written by the same
+// acceptTrade transaction, so either both marbles move or neither does.
+// Proposals are stored on the ledger under the proposing transaction's ID and expire a
+// given number of seconds after the proposing transaction's timestamp. Either side of a
+// trade may cancel it while it is still open.
+// =========================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	tradeProposed  = "proposed"
+	tradeAccepted  = "accepted"
+	tradeCancelled = "cancelled"
+)
+
+type marbleTrade struct {
+	ObjectType      string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	ID              string `json:"id"`
+	OfferedMarble   string `json:"offeredMarble"`
+	OfferedBy       string `json:"offeredBy"`
+	RequestedMarble string `json:"requestedMarble"`
+	RequestedFrom   string `json:"requestedFrom"`
+	Price           int    `json:"price"`
+	Expires         int64  `json:"expires"` //unix seconds, compared against the accepting transaction's timestamp
+	Status          string `json:"status"`
+
+	OfferedByIdentity     marbleIdentity `json:"offeredByIdentity"`
+	RequestedFromIdentity marbleIdentity `json:"requestedFromIdentity"`
+}
+
+// ============================================================================
+// proposeTrade - offer to swap a marble for another owner's marble
+// ============================================================================
+func (t *SimpleChaincode) proposeTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	//      0          1         2       3
+	// "marble2", "marble3", "3600", ["10"]
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start proposeTrade")
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if args[0] == args[1] {
+		return shim.Error("A marble cannot be traded for itself")
+	}
+	ttl, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || ttl <= 0 {
+		return shim.Error("3rd argument must be a positive numeric string")
+	}
+	price := 0
+	if len(args) == 4 {
+		price, err = strconv.Atoi(args[3])
+		if err != nil || price < 0 {
+			return shim.Error("4th argument must be a non-negative numeric string")
+		}
+	}
+
+	offered, err := getMarble(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requested, err := getMarble(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if offered.Owner == requested.Owner {
+		return shim.Error("Both marbles are already owned by " + offered.Owner)
+	}
+	err = assertMarbleOwner(stub, offered)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	trade := &marbleTrade{
+		ObjectType:      "marbleTrade",
+		ID:              stub.GetTxID(),
+		OfferedMarble:   offered.Name,
+		OfferedBy:       offered.Owner,
+		RequestedMarble: requested.Name,
+		RequestedFrom:   requested.Owner,
+		Price:           price,
+		Expires:         txTime.Unix() + ttl,
+		Status:          tradeProposed,
+
+		OfferedByIdentity:     offered.OwnerIdentity,
+		RequestedFromIdentity: requested.OwnerIdentity,
+	}
+	tradeJSONasBytes, err := putTrade(stub, trade)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end proposeTrade " + trade.ID)
+	return shim.Success(tradeJSONasBytes)
+}
+
+// ============================================================================
+// acceptTrade - swap the owners of both marbles of a proposed trade
+// ============================================================================
+func (t *SimpleChaincode) acceptTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "tradeID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	trade, err := getOpenTrade(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start acceptTrade " + trade.ID)
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if txTime.Unix() > trade.Expires {
+		return shim.Error("Trade " + trade.ID + " expired at " + time.Unix(trade.Expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	// ==== Both marbles must still belong to the owners the trade was proposed between ====
+	offered, err := getMarble(stub, trade.OfferedMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requested, err := getMarble(stub, trade.RequestedMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if offered.Owner != trade.OfferedBy || offered.OwnerIdentity != trade.OfferedByIdentity {
+		return shim.Error("Marble " + offered.Name + " is no longer owned by " + trade.OfferedBy)
+	}
+	if requested.Owner != trade.RequestedFrom || requested.OwnerIdentity != trade.RequestedFromIdentity {
+		return shim.Error("Marble " + requested.Name + " is no longer owned by " + trade.RequestedFrom)
+	}
+	err = assertMarbleOwner(stub, requested)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotEscrowed(stub, offered.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotEscrowed(stub, requested.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, offered.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertMarbleNotAuctioned(stub, requested.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Swap. Both writes are part of this transaction and commit together ====
+	// Each owning identity gives up a marble for the one it gets, so the number of marbles
+	// counted against its quota does not change and needs no check.
+	offeredTransfer, err := changeMarbleOwner(stub, offered, trade.RequestedFrom, trade.RequestedFromIdentity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requestedTransfer, err := changeMarbleOwner(stub, requested, trade.OfferedBy, trade.OfferedByIdentity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = setMarbleEvent(stub, marblesTransferredEvent, marbleBatchTransfer{Transfers: []marbleTransfer{*offeredTransfer, *requestedTransfer}})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	trade.Status = tradeAccepted
+	tradeJSONasBytes, err := putTrade(stub, trade)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end acceptTrade (success)")
+	return shim.Success(tradeJSONasBytes)
+}
+
+// ============================================================================
+// cancelTrade - withdraw (proposer) or decline (counterparty) a proposed trade
+// ============================================================================
+func (t *SimpleChaincode) cancelTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "tradeID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	trade, err := getOpenTrade(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = assertSubmitter(stub, trade.OfferedByIdentity, trade.RequestedFromIdentity)
+	if err != nil {
+		return shim.Error("Only the parties to trade " + trade.ID + " can cancel it: " + err.Error())
+	}
+
+	trade.Status = tradeCancelled
+	tradeJSONasBytes, err := putTrade(stub, trade)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end cancelTrade " + trade.ID)
+	return shim.Success(tradeJSONasBytes)
+}
+
+// ============================================================================
+// readTrade - read a trade proposal from chaincode state
+// ============================================================================
+func (t *SimpleChaincode) readTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "tradeID"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	trade, err := getTrade(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tradeJSONasBytes, err := json.Marshal(trade)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(tradeJSONasBytes)
+}
+
+// trades live under a composite key so that they stay out of marble range queries
+func tradeKey(stub shim.ChaincodeStubInterface, tradeID string) (string, error) {
+	return stub.CreateCompositeKey("marbleTrade", []string{tradeID})
+}
+
+func getTrade(stub shim.ChaincodeStubInterface, tradeID string) (*marbleTrade, error) {
+	key, err := tradeKey(stub, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	tradeAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get trade:%s", err.Error())
+	} else if tradeAsBytes == nil {
+		return nil, fmt.Errorf("Trade does not exist: %s", tradeID)
+	}
+
+	trade := &marbleTrade{}
+	err = json.Unmarshal(tradeAsBytes, trade)
+	if err != nil {
+		return nil, err
+	}
+	return trade, nil
+}
+
+// getOpenTrade returns the trade only if it has not been accepted or cancelled yet
+func getOpenTrade(stub shim.ChaincodeStubInterface, tradeID string) (*marbleTrade, error) {
+	trade, err := getTrade(stub, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if trade.Status != tradeProposed {
+		return nil, fmt.Errorf("Trade %s has already been %s", tradeID, trade.Status)
+	}
+	return trade, nil
+}
+
+func putTrade(stub shim.ChaincodeStubInterface, trade *marbleTrade) ([]byte, error) {
+	key, err := tradeKey(stub, trade.ID)
+	if err != nil {
+		return nil, err
+	}
+	tradeJSONasBytes, err := json.Marshal(trade)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, tradeJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return tradeJSONasBytes, nil
+}